@@ -1,8 +1,10 @@
 package fileserver
 
 import (
+	"bytes"
 	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -152,34 +154,145 @@ func (s *FileServer) forward(kd KeyData) error {
 	return gob.NewEncoder(mw).Encode(kd)
 }
 
+// PutError is returned by Put and ResumePut when a resumable upload is
+// interrupted. the upload can be continued with ResumePut, from Offset
+type PutError struct {
+	UploadID string
+	Offset   int64
+	Err      error
+}
+
+func (e *PutError) Error() string {
+	return fmt.Sprintf("upload %s interrupted at offset %d: %v", e.UploadID, e.Offset, e.Err)
+}
+
+func (e *PutError) Unwrap() error {
+	return e.Err
+}
+
 // not sure about this signature. how will reader be created?
 // maybe []bytes is better? but then what about large writes?
+//
+// if the store is a store.Uploader, the data is written in an upload
+// session, and a failure part way returns a *PutError to resume from
 func (s *FileServer) Put(key string, r io.Reader) error {
+	if up, ok := s.Store.(store.Uploader); ok {
+		id, err := up.BeginUpload(key)
+		if err == nil {
+			return s.upload(up, id, key, 0, r)
+		}
+		// eg a CachedFS over a store without uploads
+		if !errors.Is(err, store.ErrUnsupported) {
+			return err
+		}
+	}
+
 	w, err := s.Store.Create(key)
 	if err != nil {
 		return err
 	}
-	tReader := io.TeeReader(r, w)
+	err = s.stream(key, r, func(data []byte) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		// closing would commit the partial data
+		if a, ok := w.(store.Aborter); ok {
+			a.Abort()
+		}
+		return err
+	}
+	return w.Close()
+}
+
+// ResumePut continues an interrupted Put. r must continue from the
+// offset of the upload, see UploadOffset
+func (s *FileServer) ResumePut(uploadID string, r io.Reader) error {
+	up, ok := s.Store.(store.Uploader)
+	if !ok {
+		return fmt.Errorf("store %T doesn't support resumable uploads", s.Store)
+	}
+	st, err := up.UploadStatus(uploadID)
+	if err != nil {
+		return err
+	}
+	return s.upload(up, uploadID, st.Key, st.Offset, r)
+}
+
+// UploadOffset is the number of bytes of an upload the store has durably
+// received
+func (s *FileServer) UploadOffset(uploadID string) (int64, error) {
+	up, ok := s.Store.(store.Uploader)
+	if !ok {
+		return 0, fmt.Errorf("store %T doesn't support resumable uploads", s.Store)
+	}
+	st, err := up.UploadStatus(uploadID)
+	if err != nil {
+		return 0, err
+	}
+	return st.Offset, nil
+}
+
+// Copy copies the key src to dst in the store, without transferring the
+// content
+func (s *FileServer) Copy(src string, dst string) error {
+	c, ok := s.Store.(store.Copier)
+	if !ok {
+		return fmt.Errorf("store %T doesn't support copies", s.Store)
+	}
+	return c.Copy(src, dst)
+}
+
+// Rename renames the key src to dst in the store, without transferring
+// the content
+func (s *FileServer) Rename(src string, dst string) error {
+	c, ok := s.Store.(store.Copier)
+	if !ok {
+		return fmt.Errorf("store %T doesn't support renames", s.Store)
+	}
+	return c.Rename(src, dst)
+}
+
+// upload appends r to the upload session from offset and completes it
+func (s *FileServer) upload(up store.Uploader, id string, key string, offset int64, r io.Reader) error {
+	err := s.stream(key, r, func(data []byte) error {
+		next, err := up.AppendUpload(id, offset, bytes.NewReader(data))
+		offset = next
+		return err
+	})
+	if err != nil {
+		return &PutError{UploadID: id, Offset: offset, Err: err}
+	}
+	_, err = up.CompleteUpload(id)
+	return err
+}
+
+// stream reads r in chunks, writing each with write and forwarding it to the peers
+func (s *FileServer) stream(key string, r io.Reader, write func([]byte) error) error {
 	// todo configuration
 	buf := make([]byte, 256*1024*1024)
 	cnt := 0
 	for {
-
-		n, err := tReader.Read(buf)
+		n, err := r.Read(buf)
 		cnt += n
-		s.lggr.Sugar().Debugf("read %d (+%d) from tee", cnt, n)
-		if err != nil {
-			if err == io.EOF {
-				s.lggr.Sugar().Debug("eof of tee reader")
-				break
+		s.lggr.Sugar().Debugf("read %d (+%d)", cnt, n)
+		if n > 0 {
+			werr := write(buf[:n])
+			if werr != nil {
+				return werr
+			}
+			werr = s.forward(KeyData{key, buf[:n]})
+			if werr != nil {
+				return werr
 			}
-			s.lggr.Sugar().Errorf("error tee reader: %+v", err)
-			return err
 		}
-		err = s.forward(KeyData{key, buf})
 		if err != nil {
+			if err == io.EOF {
+				s.lggr.Sugar().Debug("eof of reader")
+				return nil
+			}
+			s.lggr.Sugar().Errorf("error reading: %+v", err)
 			return err
 		}
 	}
-	return nil
 }
@@ -0,0 +1,250 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrBatchDone = errors.New("batch already committed or aborted")
+
+// Batch publishes several blobs together. blobs created in a batch are
+// staged when closed, and only become visible when the batch is
+// committed, all at once. if the store crashes before the commit is
+// journaled the staged content is rolled back when it is reopened,
+// after that the commit is completed
+type Batch struct {
+	s *BlobStore
+
+	mu    sync.Mutex
+	blobs []*batchBlob
+	done  bool
+}
+
+type batchBlob struct {
+	*Blob
+	staged string
+	closed bool
+}
+
+// NewBatch starts a batch. it must be committed or aborted
+func (s *BlobStore) NewBatch() *Batch {
+	return &Batch{s: s}
+}
+
+// Create starts writing key as part of the batch. the blob must be closed
+// before the batch is committed
+func (b *Batch) Create(key string, opts ...CreateOpt) (WriteFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return nil, ErrBatchDone
+	}
+	w, err := b.s.create(key, b.onClose, opts...)
+	if err != nil {
+		return nil, err
+	}
+	b.blobs = append(b.blobs, &batchBlob{Blob: w, staged: w.f.Name()})
+	return w, nil
+}
+
+func (b *Batch) onClose(blob *Blob) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return ErrBatchDone
+	}
+	for _, bb := range b.blobs {
+		if bb.Blob == blob {
+			bb.closed = true
+		}
+	}
+	return nil
+}
+
+// Commit makes the keys of the batch visible at once. if a blob of the
+// batch is still open, or committing fails before it is journaled, the
+// batch is aborted
+func (b *Batch) Commit() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return ErrBatchDone
+	}
+	b.done = true
+	for _, bb := range b.blobs {
+		if !bb.closed {
+			b.abort()
+			return fmt.Errorf("can't commit batch, blob '%s' is not closed", bb.key)
+		}
+	}
+	if len(b.blobs) == 0 {
+		return nil
+	}
+
+	items, err := b.prepare()
+	if err != nil {
+		return err
+	}
+	grp, err := b.commitLocked(items)
+	for errors.Is(err, errStalePrepare) {
+		err = b.reprepare(items)
+		if err != nil {
+			return err
+		}
+		grp, err = b.commitLocked(items)
+	}
+	if err != nil || grp == nil {
+		return err
+	}
+	return b.s.group.wait(grp)
+}
+
+// prepare prepares the blobs of the batch for committing, see
+// BlobStore.prepare. if one fails, the batch is aborted. b.mu must be held
+func (b *Batch) prepare() ([]*writeIntent, error) {
+	items := make([]*writeIntent, len(b.blobs))
+	for i, bb := range b.blobs {
+		in, err := b.s.prepare(bb.Blob, bb.staged)
+		if err != nil {
+			b.drop(items)
+			return nil, err
+		}
+		items[i] = in
+	}
+	return items, nil
+}
+
+// reprepare prepares the items that were deduplicated against content
+// released since again. if one fails, the batch is aborted. b.mu must be held
+func (b *Batch) reprepare(items []*writeIntent) error {
+	for i, in := range items {
+		if in.prepared {
+			continue
+		}
+		in, err := b.s.prepare(b.blobs[i].Blob, in.written)
+		if err != nil {
+			items[i] = nil
+			b.drop(items)
+			return err
+		}
+		items[i] = in
+	}
+	return nil
+}
+
+// drop discards the blobs of the batch, and what was prepared of them.
+// items are the intents prepared so far, nil if not prepared. b.mu must be held
+func (b *Batch) drop(items []*writeIntent) {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+	b.dropLocked(items)
+}
+
+// dropLocked is drop with s.mu held
+func (b *Batch) dropLocked(items []*writeIntent) {
+	for i, bb := range b.blobs {
+		b.discard(bb)
+		if in := items[i]; in != nil {
+			b.s.dropPrepared(bb.Blob, in)
+			b.s.unpinPrepared(in)
+		}
+	}
+}
+
+// commitLocked does the part of Commit that needs s.mu. it returns the
+// group to wait for with group commit. b.mu must be held
+func (b *Batch) commitLocked(items []*writeIntent) (*commitGroup, error) {
+	s := b.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, in := range items {
+		if s.stale(in) {
+			return nil, errStalePrepare
+		}
+	}
+	defer func() {
+		for _, in := range items {
+			s.unpinPrepared(in)
+		}
+	}()
+	// conditions are checked against the store before the batch
+	for _, bb := range b.blobs {
+		err := s.checkCondition(bb.Blob)
+		if err != nil {
+			b.dropLocked(items)
+			return nil, err
+		}
+	}
+	for i, in := range items {
+		err := s.stage(in)
+		if err != nil {
+			for _, in := range items[:i] {
+				os.Remove(s.fullPath(in.Staged))
+			}
+			for k, bb := range b.blobs[i+1:] {
+				s.dropPrepared(bb.Blob, items[i+1+k])
+			}
+			return nil, err
+		}
+	}
+	batch := &writeIntent{
+		ID:      "batch-" + items[0].ID,
+		Created: time.Now(),
+		Batch:   items,
+	}
+	err := s.journal.begin(batch)
+	if err != nil {
+		for _, in := range items {
+			os.Remove(s.fullPath(in.Staged))
+		}
+		return nil, err
+	}
+	entries := make([]*indexEntry, 0, len(items))
+	for _, in := range items {
+		err = s.place(in)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, in.entry())
+	}
+	err = s.registerAll(entries)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		b.blobs[i].committed(e)
+	}
+	return s.end(batch)
+}
+
+// Abort discards the blobs of the batch
+func (b *Batch) Abort() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return ErrBatchDone
+	}
+	b.done = true
+	b.abort()
+	return nil
+}
+
+// abort discards the blobs. b.mu must be held
+func (b *Batch) abort() {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+	for _, bb := range b.blobs {
+		b.discard(bb)
+	}
+}
+
+// discard deletes the staged data of bb. b.mu and s.mu must be held
+func (b *Batch) discard(bb *batchBlob) {
+	if !bb.closed && bb.f != nil {
+		bb.Blob.discard()
+	}
+	b.s.dropStaged(bb.Blob, bb.staged)
+}
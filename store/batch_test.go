@@ -0,0 +1,158 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeBatch(t *testing.T, b *Batch, key string, data []byte) *Blob {
+	t.Helper()
+	w, err := b.Create(key)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return w.(*Blob)
+}
+
+func TestBlobStore_Batch(t *testing.T) {
+	config := BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	putBlob(t, s, "a", []byte("old a"))
+
+	// readers see all of the batch or none of it
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// each check reads the key that is visible later first
+			_, okB := s.blobMap.Get("b")
+			ea, _ := s.blobMap.Get("a")
+			if okB {
+				assert.Equal(t, int64(len("newer a")), ea.Size)
+			}
+			ea, _ = s.blobMap.Get("a")
+			_, okB = s.blobMap.Get("b")
+			if ea.Size == int64(len("newer a")) {
+				assert.True(t, okB)
+			}
+		}
+	}()
+
+	b := s.NewBatch()
+	wa := writeBatch(t, b, "a", []byte("newer a"))
+	writeBatch(t, b, "b", []byte("new b"))
+	writeBatch(t, b, "b2", []byte("new b"))
+	_, err = s.Open("b")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	got, err := s.ReadFile("a")
+	require.NoError(t, err)
+	assert.Equal(t, "old a", string(got))
+
+	require.NoError(t, b.Commit())
+	close(stop)
+	wg.Wait()
+	for key, want := range map[string]string{"a": "newer a", "b": "new b", "b2": "new b"} {
+		got, err := s.ReadFile(key)
+		assert.NoError(t, err, key)
+		assert.Equal(t, want, string(got), key)
+	}
+	info, err := wa.Stat()
+	require.NoError(t, err)
+	assert.NotEmpty(t, info.Sys().(*BlobSys).Digest.Sum)
+	assert.ErrorIs(t, b.Commit(), ErrBatchDone)
+	_, err = b.Create("c")
+	assert.ErrorIs(t, err, ErrBatchDone)
+
+	// aborted batches leave nothing behind
+	b = s.NewBatch()
+	writeBatch(t, b, "c", []byte("c"))
+	open, err := b.Create("d")
+	require.NoError(t, err)
+	require.NoError(t, b.Abort())
+	_, err = s.Open("c")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	staging, err := os.ReadDir(s.journal.stagingDir())
+	require.NoError(t, err)
+	assert.Len(t, staging, 0)
+	assert.Error(t, open.Close())
+	assert.Equal(t, int64(0), s.Usage().Pending)
+
+	// a blob left open aborts the commit
+	b = s.NewBatch()
+	writeBatch(t, b, "e", []byte("e"))
+	_, err = b.Create("f")
+	require.NoError(t, err)
+	assert.Error(t, b.Commit())
+	_, err = s.Open("e")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	staging, err = os.ReadDir(s.journal.stagingDir())
+	require.NoError(t, err)
+	assert.Len(t, staging, 0)
+}
+
+func TestBlobStore_BatchRecover(t *testing.T) {
+	config := BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+
+	// crashed before the commit was journaled: rolled back
+	rolledBack := s.NewBatch()
+	writeBatch(t, rolledBack, "x", []byte("x"))
+
+	// crashed after the commit was journaled, part way through placing: rolled forward
+	b := s.NewBatch()
+	items := make([]*writeIntent, 0)
+	for i := 0; i < 3; i++ {
+		blob := writeBatch(t, b, fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("content %d", i)))
+		in, err := s.prepare(blob, b.blobs[i].staged)
+		require.NoError(t, err)
+		s.mu.Lock()
+		require.NoError(t, s.stage(in))
+		s.mu.Unlock()
+		items = append(items, in)
+	}
+	require.NoError(t, s.journal.begin(&writeIntent{ID: "batch-test", Created: time.Now(), Batch: items}))
+	require.NoError(t, s.place(items[0]))
+
+	require.NoError(t, s.Close())
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		got, err := s.ReadFile(fmt.Sprintf("k%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("content %d", i), string(got))
+	}
+	_, err = s.Open("x")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	staging, err := os.ReadDir(s.journal.stagingDir())
+	require.NoError(t, err)
+	assert.Len(t, staging, 0)
+	intents, err := s.journal.pending()
+	require.NoError(t, err)
+	assert.Len(t, intents, 0)
+}
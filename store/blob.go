@@ -2,7 +2,6 @@ package store
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
@@ -21,8 +20,20 @@ const (
 
 type closeFn func(b *Blob) error
 
+// abortFn is called after a writable blob was aborted, with the name of
+// its discarded temp file
+type abortFn func(b *Blob, name string)
+
+// writeFn is called before n bytes are written to b. the blob is discarded
+// if it returns an error
+type writeFn func(b *Blob, n int64) error
+
 var _ WriteFile = (*Blob)(nil)
 var _ fs.File = (*Blob)(nil)
+var _ io.ReaderAt = (*Blob)(nil)
+var _ io.Seeker = (*Blob)(nil)
+var _ io.WriterTo = (*Blob)(nil)
+var _ Aborter = (*Blob)(nil)
 
 type Blob struct {
 	mode blobMode
@@ -31,10 +42,29 @@ type Blob struct {
 	name string
 
 	closeFn
+	abortFn     abortFn
+	writeFn     writeFn
+	tempDir     string
+	syncOnClose bool
+	hashAlg     HashAlgorithm
 	//handle File
 	hash.Hash
 	f           *os.File
 	multiWriter io.Writer
+	// size is the number of bytes written
+	size int64
+	// reader serves reads of a read only blob
+	reader *io.SectionReader
+	closer io.Closer
+
+	key     string
+	digest  Digest
+	modTime time.Time
+	meta    ObjectMeta
+	ttl     time.Duration
+	version int64
+	// cond must hold for a writable blob to be committed
+	cond condition
 }
 
 type BlobOpt func(*Blob)
@@ -45,67 +75,230 @@ func WithCloseFn(fn closeFn) BlobOpt {
 	}
 }
 
+// WithAbortFn sets a function that is called when the blob is aborted
+func WithAbortFn(fn abortFn) BlobOpt {
+	return func(b *Blob) {
+		b.abortFn = fn
+	}
+}
+
+// WithWriteFn sets a function that can refuse writes, eg when out of space
+func WithWriteFn(fn writeFn) BlobOpt {
+	return func(b *Blob) {
+		b.writeFn = fn
+	}
+}
+
+// tempBlobPrefix starts the names of the files of blobs written to the os
+// temp dir, so that gc can tell them from the files of other programs
+const tempBlobPrefix = "foreverstore-blob-"
+
+// WithTempDir sets the directory the blob is written to before it is closed.
+// defaults to the os temp dir
+func WithTempDir(dir string) BlobOpt {
+	return func(b *Blob) {
+		b.tempDir = dir
+	}
+}
+
+// WithSyncOnClose flushes the written data to disk before the close fn runs
+func WithSyncOnClose() BlobOpt {
+	return func(b *Blob) {
+		b.syncOnClose = true
+	}
+}
+
+// WithHashAlgorithm sets the algorithm used to digest the written content
+func WithHashAlgorithm(alg HashAlgorithm) BlobOpt {
+	return func(b *Blob) {
+		b.hashAlg = alg
+	}
+}
+
 // read vs write blob?
 func NewWritableBlob(name string, opts ...BlobOpt) (*Blob, error) {
+	b := &Blob{
+		name:    name,
+		key:     name,
+		mode:    ReadWrite,
+		hashAlg: DefaultHashAlgorithm,
+		modTime: time.Now(),
+	}
 
-	t, err := os.CreateTemp("", fmt.Sprintf("blob-%s", name))
+	for _, opt := range opts {
+		opt(b)
+	}
+	hashWriter, err := b.hashAlg.New()
 	if err != nil {
 		return nil, err
 	}
-	hashWriter := sha256.New()
-	b := &Blob{
-		name:        name,
-		mode:        ReadWrite,
-		Hash:        hashWriter,
-		f:           t,
-		multiWriter: io.MultiWriter(t, hashWriter),
+	b.Hash = hashWriter
+
+	// the name is a key and may contain path separators, so it can't be
+	// part of the temp file pattern
+	pattern := "blob-*"
+	if b.tempDir == "" {
+		pattern = tempBlobPrefix + "*"
+	}
+	t, err := os.CreateTemp(b.tempDir, pattern)
+	if err != nil {
+		return nil, err
 	}
+	b.f = t
+	b.multiWriter = io.MultiWriter(t, hashWriter)
+	return b, nil
+}
 
-	for _, opt := range opts {
-		opt(b)
+// NewReadonlyBlob opens the file at path for reading
+func NewReadonlyBlob(path string) (*Blob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	b := newReaderBlob(path, f, info.Size(), f)
+	b.modTime = info.ModTime()
 	return b, nil
 }
 
-func NewReadonlyBlob(name string) (*Blob, error) {
+// newReaderBlob is a read only blob of size bytes served by r
+func newReaderBlob(name string, r io.ReaderAt, size int64, c io.Closer) *Blob {
 	return &Blob{
-		mode: ReadOnly,
-		name: name,
-	}, nil
+		mode:    ReadOnly,
+		name:    name,
+		size:    size,
+		modTime: time.Now(),
+		reader:  io.NewSectionReader(r, 0, size),
+		closer:  c,
+	}
 }
 
 func (b *Blob) Write(buf []byte) (int, error) {
 	if b.mode == ReadOnly {
 		return 0, fmt.Errorf("can't write a read only blob")
 	}
+	if b.f == nil {
+		return 0, fs.ErrClosed
+	}
+	if b.writeFn != nil {
+		if err := b.writeFn(b, int64(len(buf))); err != nil {
+			b.discard()
+			return 0, err
+		}
+	}
 	r := bytes.NewReader(buf)
 	n, err := io.Copy(b.multiWriter, r)
+	b.mu.Lock()
+	b.size += n
+	b.modTime = time.Now()
+	b.mu.Unlock()
 	return int(n), err
 
 }
 
 func (b *Blob) Close() error {
-
+	if b.mode == ReadOnly {
+		if b.closer == nil {
+			return fs.ErrClosed
+		}
+		err := b.closer.Close()
+		b.closer = nil
+		return err
+	}
+	if b.f == nil {
+		return fs.ErrClosed
+	}
+	if b.syncOnClose {
+		err := b.f.Sync()
+		if err != nil {
+			b.f.Close()
+			return err
+		}
+	}
 	err := b.f.Close()
 	if err != nil {
 		return err
 	}
 	if b.closeFn != nil {
 		if err := b.closeFn(b); err != nil {
-			return nil
+			return err
 		}
 	}
 	b.f = nil
 	return nil
 }
 
+// Abort discards the data written to a writable blob. it is never committed
+func (b *Blob) Abort() error {
+	if b.mode == ReadOnly || b.f == nil {
+		return fs.ErrClosed
+	}
+	name := b.f.Name()
+	b.discard()
+	if b.abortFn != nil {
+		b.abortFn(b, name)
+	}
+	return nil
+}
+
+// discard closes and deletes the temp file of a writable blob without
+// calling the close fn
+func (b *Blob) discard() {
+	b.f.Close()
+	os.Remove(b.f.Name())
+	b.f = nil
+}
+
 func (b *Blob) Read(buf []byte) (int, error) {
+	if b.mode == ReadOnly {
+		return b.reader.Read(buf)
+	}
+	if b.f == nil {
+		return 0, fs.ErrClosed
+	}
 	return b.f.Read(buf)
 }
 
+func (b *Blob) ReadAt(buf []byte, off int64) (int, error) {
+	if b.mode != ReadOnly {
+		return 0, fmt.Errorf("can't read at offset of a writable blob")
+	}
+	return b.reader.ReadAt(buf, off)
+}
+
+func (b *Blob) Seek(offset int64, whence int) (int64, error) {
+	if b.mode != ReadOnly {
+		return 0, fmt.Errorf("can't seek a writable blob")
+	}
+	return b.reader.Seek(offset, whence)
+}
+
+// WriteTo writes the rest of the blob to w, starting at the current offset
+func (b *Blob) WriteTo(w io.Writer) (int64, error) {
+	if b.mode != ReadOnly {
+		return 0, fmt.Errorf("can't read a writable blob")
+	}
+	return io.Copy(w, b.reader)
+}
+
 func (b *Blob) Stat() (os.FileInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	return &BlobInfo{
-		name: b.name,
+		name:    b.name,
+		size:    b.size,
+		modTime: b.modTime,
+		sys: &BlobSys{
+			Key:       b.key,
+			Digest:    b.digest,
+			Algorithm: b.digest.Algorithm,
+			Meta:      b.meta.clone(),
+			Version:   b.version,
+		},
 	}, nil
 }
 
@@ -122,8 +315,45 @@ func (b *Blob) rename(n string) error {
 	return nil
 }
 
+// committed records where the blob was stored
+func (b *Blob) committed(e *indexEntry) {
+	b.rename(e.Path)
+	d, err := e.digest()
+	if err == nil {
+		b.stored(d, e.ModTime)
+	}
+	b.mu.Lock()
+	b.version = e.Version
+	b.mu.Unlock()
+}
+
+// stored records the metadata of the blob once it is in a store
+func (b *Blob) stored(digest Digest, modTime time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.digest = digest
+	if !modTime.IsZero() {
+		b.modTime = modTime
+	}
+}
+
 type BlobInfo struct {
-	name string
+	name    string
+	size    int64
+	modTime time.Time
+	sys     *BlobSys
+}
+
+// BlobSys is the underlying data source of a BlobInfo. Digest is
+// only set once the blob is stored, ie after closing a writable blob
+type BlobSys struct {
+	// Key the blob is stored under
+	Key       string
+	Digest    Digest
+	Algorithm HashAlgorithm
+	Meta      ObjectMeta
+	// Version counts the changes of the key, starting at 0
+	Version int64
 }
 
 func (i *BlobInfo) Name() string {
@@ -131,7 +361,7 @@ func (i *BlobInfo) Name() string {
 }
 
 func (i *BlobInfo) Size() int64 {
-	return 0
+	return i.size
 }
 
 func (i *BlobInfo) Mode() os.FileMode {
@@ -139,12 +369,13 @@ func (i *BlobInfo) Mode() os.FileMode {
 }
 func (i *BlobInfo) ModTime() time.Time {
 	// modification time
-	return time.Unix(0, 0)
+	return i.modTime
 }
 func (i *BlobInfo) IsDir() bool {
 	return false
 } // abbreviation for Mode().IsDir()
 
+// Sys returns a *BlobSys
 func (i *BlobInfo) Sys() any {
-	return nil
+	return i.sys
 }
@@ -1,15 +1,17 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/krehermann/foreverstore/util"
 	"go.uber.org/zap"
 )
 
@@ -18,15 +20,80 @@ type BlobStoreConfig struct {
 	// optional. consider moving to opts func instead of config
 	Root   string
 	Logger *zap.Logger
+	// HashAlgorithm digests new blobs. existing blobs keep the algorithm
+	// they were written with. defaults to DefaultHashAlgorithm
+	HashAlgorithm HashAlgorithm
+	// Chunking stores new blobs as content defined chunks when set, so
+	// that similar blobs share storage. existing blobs are read either way
+	Chunking *ChunkingConfig
+	// Codec compresses new blobs (or their chunks) when set. content that
+	// doesn't look compressible is stored as is. existing blobs are
+	// decoded with the codec they were written with
+	Codec Codec
+	// KeyProvider encrypts new blobs (or their chunks) when set. it is
+	// also required to read blobs that were written encrypted. content
+	// paths are digests of the plaintext, so identical content can still
+	// be deduplicated, at the cost of revealing that it is identical
+	KeyProvider KeyProvider
+	// Pack appends new blobs that are small once encoded to shared segment
+	// files when set, rather than storing a file per blob. packed blobs
+	// are read either way. the index then keeps no record file per key,
+	// so the store fails to open rather than rebuild it if its log is
+	// lost or corrupt
+	Pack *PackConfig
+	// Scrubber periodically verifies the stored content in the
+	// background when set
+	Scrubber *ScrubberConfig
+	// Reaper periodically removes expired keys in the background when set
+	Reaper *ReaperConfig
+	// GC periodically deletes unreferenced content and stale temp files
+	// in the background when set
+	GC *GCConfig
+	// MaxSize limits the total size of the keys, in bytes. writes that
+	// would cross it fail with ErrQuotaExceeded. 0 is unlimited
+	MaxSize int64
+	// Quotas limits the total size of the keys with a prefix, in bytes
+	Quotas map[string]int64
+	// UploadTTL is how long upload sessions are kept without appends.
+	// expired sessions are removed by the reaper. defaults to DefaultUploadTTL
+	UploadTTL time.Duration
+	// Durability is what writes, removes and metadata updates survive
+	// once they return. defaults to DefaultDurability
+	Durability Durability
 }
 
 type BlobStore struct {
 	config BlobStoreConfig
 
 	registerCh chan<- *ObjectRef
-	// blobMap tracks key-> path relationship
-	// TODO persistency & loading
-	blobMap *util.ConcurrentMap[string, string]
+	// blobMap tracks key-> path relationship. it is persisted under
+	// the root and reloaded by NewBlobStore
+	blobMap *blobIndex
+	// journal makes commits of written blobs crash safe
+	journal *journal
+	// packs holds small content in segment files
+	packs *packStore
+	// uploads are the resumable upload sessions
+	uploads *uploads
+	// mu serializes changes to which content is referenced, so that
+	// content isn't deleted while another key is being pointed at it
+	mu sync.Mutex
+	// chunks tracks the chunks referenced by chunk manifests
+	chunks map[string]*chunkRef
+	// inflight are the staging files of blobs that are being written
+	inflight map[string]struct{}
+	// pins protect content from being deleted, eg while it is exported.
+	// releases of pinned content are deferred until it is unpinned
+	pins     map[string]int
+	deferred map[string]*indexEntry
+	usage    *usage
+	// group shares syncs between commits with DurabilityGroupCommit
+	group *groupCommit
+
+	// background work is stopped by closing quitCh
+	quitCh    chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
 }
 
 var _ ReadWriteStatFS = (*BlobStore)(nil)
@@ -35,6 +102,53 @@ func NewBlobStore(config BlobStoreConfig) (*BlobStore, error) {
 	if config.PathFunc == nil {
 		config.PathFunc = ContentPath
 	}
+	if config.HashAlgorithm == 0 {
+		config.HashAlgorithm = DefaultHashAlgorithm
+	}
+	if !config.HashAlgorithm.Valid() {
+		return nil, fmt.Errorf("unsupported hash algorithm %s", config.HashAlgorithm)
+	}
+	if config.MaxSize < 0 {
+		return nil, fmt.Errorf("invalid max size %d", config.MaxSize)
+	}
+	if !config.Durability.Valid() {
+		return nil, fmt.Errorf("invalid durability %s", config.Durability)
+	}
+	if config.UploadTTL < 0 {
+		return nil, fmt.Errorf("invalid upload ttl %s", config.UploadTTL)
+	}
+	if config.UploadTTL == 0 {
+		config.UploadTTL = DefaultUploadTTL
+	}
+	if config.Durability == DurabilityDefault {
+		config.Durability = DefaultDurability
+	}
+	for p, limit := range config.Quotas {
+		if limit < 0 {
+			return nil, fmt.Errorf("invalid quota %d for prefix '%s'", limit, p)
+		}
+	}
+	if config.Chunking != nil {
+		c := *config.Chunking
+		err := c.setDefaults()
+		if err != nil {
+			return nil, err
+		}
+		config.Chunking = &c
+	}
+	segmentSize := int64(0)
+	if config.Pack != nil {
+		c := *config.Pack
+		err := c.setDefaults()
+		if err != nil {
+			return nil, err
+		}
+		config.Pack = &c
+		segmentSize = c.SegmentSize
+	}
+	if config.Codec != nil {
+		RegisterCodec(config.Codec)
+	}
 	if config.Logger == nil {
 		var err error
 		config.Logger, err = zap.NewDevelopment()
@@ -59,21 +173,213 @@ func NewBlobStore(config BlobStoreConfig) (*BlobStore, error) {
 		}
 	}
 
-	return &BlobStore{
+	idx, err := openIndex(config.Root, config.Durability, config.Pack == nil, config.Logger)
+	if err != nil {
+		return nil, err
+	}
+	config.Logger.Sugar().Infof("loaded %d keys from %s", idx.Len(), config.Root)
+
+	j, err := openJournal(config.Root, config.Durability, config.Logger)
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+
+	packs, err := openPacks(config.Root, segmentSize, config.Durability, config.Logger)
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	ups, err := openUploads(config.Root, config.UploadTTL)
+	if err != nil {
+		idx.Close()
+		packs.close()
+		return nil, err
+	}
+
+	s := &BlobStore{
 		config:     config,
 		registerCh: make(chan<- *ObjectRef),
-		blobMap:    util.NewConcurrentMap[string, string](),
-	}, nil
+		blobMap:    idx,
+		journal:    j,
+		packs:      packs,
+		uploads:    ups,
+		chunks:     make(map[string]*chunkRef),
+		inflight:   make(map[string]struct{}),
+		pins:       make(map[string]int),
+		deferred:   make(map[string]*indexEntry),
+		usage:      newUsage(config.MaxSize, config.Quotas),
+		quitCh:     make(chan struct{}),
+	}
+	s.group = &groupCommit{flush: s.flushGroup}
+	for _, e := range idx.Values() {
+		s.usage.add(e.Key, e.Size)
+	}
+	err = s.loadChunkRefs()
+	if err == nil {
+		err = s.recover()
+	}
+	if err == nil {
+		err = s.loadUploads()
+	}
+	if err != nil {
+		idx.Close()
+		packs.close()
+		return nil, err
+	}
+	if config.Scrubber != nil {
+		s.startScrubber(*config.Scrubber)
+	}
+	if config.GC != nil {
+		s.startGC(*config.GC)
+	}
+	if config.Reaper != nil {
+		s.startReaper(*config.Reaper)
+	}
+	return s, nil
 }
 
+// Close stops background work and releases the resources held by the
+// store. the store can be reopened with NewBlobStore on the same root
+func (s *BlobStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.quitCh)
+	})
+	s.wg.Wait()
+	err := s.packs.close()
+	if cerr := s.blobMap.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// every runs fn right away and then every interval, until the store is
+// closed. the context passed to fn is canceled when the store is closed
+func (s *BlobStore) every(interval time.Duration, fn func(ctx context.Context)) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-s.quitCh
+			cancel()
+		}()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			fn(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Remove deletes key. the content is only deleted once no other key references it
 func (s *BlobStore) Remove(key string) error {
 	s.config.Logger.Sugar().Infof("removing key %s", key)
-	pth, ok := s.blobMap.Get(key)
+	s.mu.Lock()
+	e, ok := s.blobMap.Get(key)
 	if !ok {
+		s.mu.Unlock()
 		return fmt.Errorf("%w: %s", os.ErrNotExist, key)
 	}
+	err := s.removeEntry(e)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.syncIndex()
+}
+
+// removeEntry deletes the key of e. s.mu must be held
+func (s *BlobStore) removeEntry(e *indexEntry) error {
+	key := e.Key
+	// remove from map first, a crash before the content is deleted
+	// leaves an unreferenced file rather than a dangling key
+	err := s.blobMap.Delete(key)
+	if err != nil {
+		return err
+	}
+	s.usage.add(key, -e.Size)
+	return s.release(e)
+}
+
+// release deletes the content of e if nothing references it anymore.
+// s.mu must be held
+func (s *BlobStore) release(e *indexEntry) error {
+	if refs := s.blobMap.Refs(e.Path); refs > 0 {
+		s.config.Logger.Sugar().Debugf("keeping %s, still referenced by %d keys", e.Path, refs)
+		return nil
+	}
+	if s.pins[e.Path] > 0 {
+		s.config.Logger.Sugar().Debugf("deferring release of pinned %s", e.Path)
+		s.deferred[e.Path] = e
+		return nil
+	}
+	if e.Chunked {
+		err := s.releaseChunks(e.Path)
+		if err != nil {
+			return err
+		}
+	} else if ref, ok := s.chunks[e.Path]; ok && ref.refs > 0 {
+		s.config.Logger.Sugar().Debugf("keeping %s, still referenced as a chunk", e.Path)
+		return nil
+	}
+	return s.removeStored(e.Path, e.storage)
+}
+
+// pin protects the content at paths from deletion until unpinned. s.mu must be held
+func (s *BlobStore) pin(paths []string) {
+	for _, p := range paths {
+		s.pins[p]++
+	}
+}
+
+// unpin undoes pin, completing releases deferred while pinned
+func (s *BlobStore) unpin(paths []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unpinLocked(paths)
+}
+
+// unpinLocked is unpin with s.mu held
+func (s *BlobStore) unpinLocked(paths []string) error {
+	var err error
+	for _, p := range paths {
+		s.pins[p]--
+		if s.pins[p] > 0 {
+			continue
+		}
+		delete(s.pins, p)
+		e, ok := s.deferred[p]
+		if !ok {
+			continue
+		}
+		delete(s.deferred, p)
+		if rerr := s.release(e); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// removeStored deletes the content at pth, stored as st. s.mu must be held
+func (s *BlobStore) removeStored(pth string, st storage) error {
+	if st.Packed {
+		return s.packs.remove(pth)
+	}
+	return s.removeContent(pth)
+}
+
+// removeContent deletes the file at pth and any fan out dirs left empty.
+// s.mu must be held
+func (s *BlobStore) removeContent(pth string) error {
 	fp := s.fullPath(pth)
-	s.config.Logger.Sugar().Debugf("removing key '%s' at path %s", key, fp)
+	s.config.Logger.Sugar().Debugf("removing content at path %s", fp)
 	// delete the file
 
 	err := os.Remove(fp)
@@ -81,9 +387,6 @@ func (s *BlobStore) Remove(key string) error {
 		return err
 	}
 
-	// remove from map
-	s.blobMap.Delete(key)
-
 	filepath.Walk(s.config.Root, func(path string, info fs.FileInfo, err error) error {
 		s.config.Logger.Sugar().Debugf("walking root %s: %s %v %v", s.config.Root,
 			path, info, err)
@@ -137,48 +440,559 @@ func (s *BlobStore) Remove(key string) error {
 	return nil
 }
 
+// onClose commits a written blob. the staged data has already been synced
+// if the durability asks for it, so once the intent is in the journal the
+// commit can always be completed by recover if we crash before it is done
 func (s *BlobStore) onClose(b *Blob) error {
-	pth := filepath.Join(s.config.Root, s.config.PathFunc(b.Hash))
-	err := os.MkdirAll(filepath.Dir(pth), 0755)
+	return s.commit(b, b.f.Name())
+}
+
+// commit commits the content of b, staged at staged. the key is visible
+// once it is registered, and commit returns once that is durable
+func (s *BlobStore) commit(b *Blob, staged string) error {
+	in, err := s.prepare(b, staged)
+	if err != nil {
+		return err
+	}
+	grp, err := s.commitLocked(b, in)
+	for errors.Is(err, errStalePrepare) {
+		in, err = s.prepare(b, staged)
+		if err != nil {
+			return err
+		}
+		grp, err = s.commitLocked(b, in)
+	}
+	if err != nil || grp == nil {
+		return err
+	}
+	return s.group.wait(grp)
+}
+
+// commitLocked does the part of commit that needs s.mu. it returns the
+// group to wait for with group commit
+func (s *BlobStore) commitLocked(b *Blob, in *writeIntent) (*commitGroup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.unpinPrepared(in)
+	if s.stale(in) {
+		return nil, errStalePrepare
+	}
+	err := s.checkCondition(b)
+	if err != nil {
+		s.dropPrepared(b, in)
+		return nil, err
+	}
+	err = s.stage(in)
+	if err != nil {
+		return nil, err
+	}
+	err = s.journal.begin(in)
+	if err != nil {
+		os.Remove(s.fullPath(in.Staged))
+		return nil, err
+	}
+	err = s.place(in)
+	if err != nil {
+		return nil, err
+	}
+	e := in.entry()
+	err = s.register(e)
+	if err != nil {
+		return nil, err
+	}
+	b.committed(e)
+	return s.end(in)
+}
+
+// errStalePrepare is returned by commitLocked when the content a commit
+// was prepared to deduplicate against was released meanwhile. the commit
+// is prepared again
+var errStalePrepare = errors.New("prepared against released content")
+
+// prepare prepares the staged data of b for committing, unless identical
+// content is already stored: it is chunked and encoded according to the
+// config. it runs without s.mu, so that encoding a large blob doesn't hold
+// up other commits, and stage settles how it is stored once s.mu is held.
+// the returned intent describes the commit. the staged data is removed on
+// error
+func (s *BlobStore) prepare(b *Blob, staged string) (*writeIntent, error) {
+	now := time.Now()
+	in := &writeIntent{
+		ID:         intentID(staged),
+		Staged:     s.relPath(staged),
+		Path:       s.config.PathFunc(b.Hash),
+		Key:        b.Name(),
+		Size:       b.size,
+		Digest:     DigestOf(b.Hash).String(),
+		Created:    now,
+		Version:    b.version,
+		ObjectMeta: b.meta.withTTL(b.ttl, now),
+		written:    staged,
+	}
+	s.mu.Lock()
+	_, exists := s.storedAs(in.Path)
+	s.mu.Unlock()
+	if exists {
+		// deduplicated by stage
+		return in, nil
+	}
+	enc, err := s.encodeStaged(staged, in)
+	if err == nil && enc != staged {
+		s.mu.Lock()
+		s.inflight[enc] = struct{}{}
+		s.mu.Unlock()
+	}
+	if err == nil && !in.Chunked && s.config.Pack != nil {
+		var info os.FileInfo
+		info, err = os.Stat(enc)
+		if err == nil {
+			in.Packed = info.Size() <= s.config.Pack.MaxObjectSize
+		}
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dropStaged(b, staged)
+		s.dropStaged(b, enc)
+		s.unpinLocked(in.pinned)
+		s.mu.Unlock()
+		return nil, err
+	}
+	in.ID = intentID(enc)
+	in.Staged = s.relPath(enc)
+	in.prepared = true
+	return in, nil
+}
+
+// stale reports whether in was prepared to be deduplicated against
+// content that was released since. s.mu must be held
+func (s *BlobStore) stale(in *writeIntent) bool {
+	if in.prepared {
+		return false
+	}
+	_, exists := s.storedAs(in.Path)
+	return !exists
+}
+
+// stage settles how the prepared content of in is stored: content that is
+// stored already, including by commits that were prepared concurrently,
+// is deduplicated against. in must not be stale. the staged data is
+// removed on error. s.mu must be held
+func (s *BlobStore) stage(in *writeIntent) error {
+	staged := s.fullPath(in.Staged)
+	delete(s.inflight, in.written)
+	delete(s.inflight, staged)
+	s.usage.unreserve(in.written, in.Key)
+	cur, exists := s.storedAs(in.Path)
+	if !exists {
+		return nil
+	}
+	// identical content is already stored, possibly chunked or encoded.
+	// the staged data is dropped by place
+	in.storage = cur
+	if cur.Chunked && !in.prepared {
+		err := s.repairChunks(in.Path, staged)
+		if err != nil {
+			os.Remove(staged)
+			return err
+		}
+	}
+	return nil
+}
+
+// unpinPrepared unpins the chunks pinned by prepare. s.mu must be held
+func (s *BlobStore) unpinPrepared(in *writeIntent) {
+	err := s.unpinLocked(in.pinned)
+	if err != nil {
+		s.config.Logger.Sugar().Warnf("failed to release content unpinned by the commit of '%s': %v", in.Key, err)
+	}
+	in.pinned = nil
+}
+
+// dropPrepared discards the prepared data of in, written by b. s.mu must be held
+func (s *BlobStore) dropPrepared(b *Blob, in *writeIntent) {
+	s.dropStaged(b, in.written)
+	s.dropStaged(b, s.fullPath(in.Staged))
+}
+
+// onAbort forgets a blob that was aborted before it was closed
+func (s *BlobStore) onAbort(b *Blob, staged string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropStaged(b, staged)
+}
+
+// dropStaged discards the staged data of b. s.mu must be held
+func (s *BlobStore) dropStaged(b *Blob, staged string) {
+	os.Remove(staged)
+	delete(s.inflight, staged)
+	s.usage.unreserve(staged, b.key)
+}
+
+// place moves the staged data of in to its content path, or drops it if
+// the content is already stored. s.mu must be held
+func (s *BlobStore) place(in *writeIntent) error {
+	if in.Packed {
+		err := s.packs.put(in.Path, s.fullPath(in.Staged))
+		if err != nil {
+			return err
+		}
+		return os.Remove(s.fullPath(in.Staged))
+	}
+	if _, ok := s.storedAs(in.Path); ok {
+		// drop the duplicate
+		return os.Remove(s.fullPath(in.Staged))
+	}
+	// a file that isn't referenced is an orphan, eg of a release
+	// interrupted by a crash. it may be stored differently, so it is
+	// replaced
+	dest := s.fullPath(in.Path)
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(b.f.Name(), pth)
+	err = os.Rename(s.fullPath(in.Staged), dest)
+	if err != nil {
+		return err
+	}
+	switch s.config.Durability {
+	case DurabilityGroupCommit:
+		// synced by the group flush
+		in.placed = true
+	case DurabilityDir:
+		return syncDir(filepath.Dir(dest))
+	}
+	return nil
+}
+
+// encodeStaged chunks and/or compresses the staged file according to the
+// config, recording how in in. the path of the file to commit is returned.
+// it runs without s.mu
+func (s *BlobStore) encodeStaged(staged string, in *writeIntent) (string, error) {
+	if s.config.Chunking != nil && in.Size > int64(s.config.Chunking.MinSize) {
+		manifest, pinned, err := s.storeChunks(staged)
+		in.pinned = pinned
+		if err != nil {
+			return staged, err
+		}
+		if manifest != "" {
+			in.Chunked = true
+			return manifest, nil
+		}
+	}
+	if s.config.Codec != nil {
+		enc, size, err := encodeFile(s.config.Codec, staged, s.journal.stagingDir(), s.config.Durability)
+		if err != nil {
+			return staged, err
+		}
+		if enc != "" {
+			in.Codec = s.config.Codec.Name()
+			in.StoredSize = size
+			err = os.Remove(staged)
+			if err != nil {
+				return enc, err
+			}
+			staged = enc
+		}
+	}
+	if s.config.KeyProvider != nil {
+		enc, size, keyID, err := encryptFile(s.config.KeyProvider, staged, s.journal.stagingDir(), s.config.Durability)
+		if err != nil {
+			return staged, err
+		}
+		in.KeyID = keyID
+		in.StoredSize = size
+		err = os.Remove(staged)
+		if err != nil {
+			return enc, err
+		}
+		staged = enc
+	}
+	return staged, nil
+}
+
+// storedAs reports how the content at pth is stored, if it is referenced
+// (by a key, a manifest or a pin) and present. s.mu must be held
+func (s *BlobStore) storedAs(pth string) (storage, bool) {
+	var st storage
+	if e, ok := s.blobMap.GetByPath(pth); ok {
+		st = e.storage
+	} else if c, ok := s.chunks[pth]; ok {
+		st = c.storage()
+	} else if e, ok := s.deferred[pth]; ok {
+		// released while pinned, eg by an export still reading it
+		st = e.storage
+	} else {
+		return st, false
+	}
+	return st, s.contentExists(pth, st)
+}
+
+// register puts e in the index and deletes the content it replaced if that
+// is no longer referenced. s.mu must be held
+func (s *BlobStore) register(e *indexEntry) error {
+	return s.registerAll([]*indexEntry{e})
+}
+
+// registerAll puts entries in the index at once, so readers see either all
+// or none of them. s.mu must be held
+func (s *BlobStore) registerAll(entries []*indexEntry) error {
+	return s.update(entries, nil)
+}
+
+// update is registerAll that also removes the keys dels at once with the
+// puts, deleting their content if it is no longer referenced. s.mu must be held
+func (s *BlobStore) update(entries []*indexEntry, dels []string) error {
+	first := make([]bool, len(entries))
+	seen := make(map[string]bool)
+	for i, e := range entries {
+		first[i] = s.blobMap.Refs(e.Path) == 0 && !seen[e.Path]
+		if _, ok := s.deferred[e.Path]; ok {
+			// referenced again before its release, its chunks are still retained
+			delete(s.deferred, e.Path)
+			first[i] = false
+		}
+		seen[e.Path] = true
+	}
+	prevs, deleted, err := s.blobMap.Update(entries, dels)
 	if err != nil {
 		return err
 	}
-	// register in the blob key->path map
-	key := b.Name()
-	b.rename(s.relPath(pth))
-	s.blobMap.Put(key, b.Name())
+	for i, e := range entries {
+		delta := e.Size
+		if prevs[i] != nil {
+			delta -= prevs[i].Size
+		}
+		s.usage.add(e.Key, delta)
+		if first[i] && e.Chunked {
+			err = s.retainChunks(e.Path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i, prev := range prevs {
+		if prev != nil && prev.Path != entries[i].Path {
+			err = s.release(prev)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, e := range deleted {
+		if e == nil {
+			continue
+		}
+		s.usage.add(e.Key, -e.Size)
+		err = s.release(e)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Stats describes the contents of the store
+type Stats struct {
+	// Keys is the number of keys
+	Keys int
+	// Objects is the number of distinct contents stored
+	Objects int
+	// LogicalBytes is the sum of the sizes of all keys
+	LogicalBytes int64
+	// PhysicalBytes is the sum of the sizes on disk of the distinct contents
+	PhysicalBytes int64
+}
+
+// SavedBytes is the space saved by deduplication and compression
+func (s Stats) SavedBytes() int64 {
+	return s.LogicalBytes - s.PhysicalBytes
+}
+
+// Stats reports logical vs physical usage. chunked contents count the
+// size of their distinct chunks, manifests are not counted
+func (s *BlobStore) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := Stats{}
+	seen := make(map[string]bool)
+	for _, e := range s.blobMap.Values() {
+		out.Keys++
+		out.LogicalBytes += e.Size
+		if !seen[e.Path] {
+			seen[e.Path] = true
+			out.Objects++
+			if !e.Chunked {
+				out.PhysicalBytes += e.storedSize()
+			}
+		}
+	}
+	for pth, c := range s.chunks {
+		if !seen[pth] {
+			out.PhysicalBytes += c.storedSize()
+		}
+	}
+	return out
+}
+
 func (s *BlobStore) Create(name string) (WriteFile, error) {
+	return s.CreateWith(name)
+}
+
+// CreateWith is Create with options, eg metadata to store with the key
+func (s *BlobStore) CreateWith(name string, opts ...CreateOpt) (WriteFile, error) {
+	return s.create(name, s.onClose, opts...)
+}
+
+// create starts a blob that is committed by fn when it is closed
+func (s *BlobStore) create(name string, fn closeFn, opts ...CreateOpt) (*Blob, error) {
+	config := &CreateConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	err := config.meta.normalize()
+	if err != nil {
+		return nil, err
+	}
+	blobOpts := []BlobOpt{
+		WithCloseFn(fn),
+		WithAbortFn(s.onAbort),
+		WithWriteFn(s.reserveWrite),
+		WithTempDir(s.journal.stagingDir()),
+		WithHashAlgorithm(s.config.HashAlgorithm),
+	}
+	if s.config.Durability.syncFiles() {
+		blobOpts = append(blobOpts, WithSyncOnClose())
+	}
 	// the blob is not tracked in the map until it's closed
-	return NewWritableBlob(name, WithCloseFn(s.onClose))
+	b, err := NewWritableBlob(name, blobOpts...)
+	if err != nil {
+		return nil, err
+	}
+	b.meta = config.meta
+	b.ttl = config.ttl
+	b.cond = config.cond
+	b.version = config.version
+	s.mu.Lock()
+	s.inflight[b.f.Name()] = struct{}{}
+	s.mu.Unlock()
+	return b, nil
 }
 
 func (s *BlobStore) ReadFile(key string) ([]byte, error) {
-	pth, ok := s.blobMap.Get(key)
-	if !ok {
-		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, key)
+	f, err := s.Open(key)
+	if err != nil {
+		return nil, err
 	}
-	return ioutil.ReadFile(s.fullPath(pth))
+	defer f.Close()
+	return io.ReadAll(f)
 }
 
 func (s *BlobStore) Open(key string) (fs.File, error) {
-	pth, ok := s.blobMap.Get(key)
-	if !ok {
+	e, ok := s.blobMap.Get(key)
+	if !ok || e.expired(time.Now()) {
 		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, key)
 	}
 
-	fp := s.fullPath(pth)
-	_, err := s.Stat(fp)
+	if !s.contentExists(e.Path, e.storage) {
+		// eg quarantined by the scrubber, until the content is written again
+		return nil, fmt.Errorf("key %s in map, but its content %s is missing: %w", key, e.Path, os.ErrNotExist)
+	}
+	digest, err := e.digest()
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.openEntry(e)
 	if err != nil {
-		panic(fmt.Sprintf("key %s in map, but underlying file %s stat fails: %v", key, fp, err))
+		return nil, err
 	}
-	return NewReadonlyBlob(s.fullPath(pth))
+	b.key = e.Key
+	b.meta = e.ObjectMeta.clone()
+	b.version = e.Version
+	b.stored(digest, e.ModTime)
+	return b, nil
+}
+
+// openEntry opens the content of e for reading
+func (s *BlobStore) openEntry(e *indexEntry) (*Blob, error) {
+	if !e.Chunked && !e.Packed && e.Codec == "" && e.KeyID == "" {
+		return NewReadonlyBlob(s.fullPath(e.Path))
+	}
+	if !e.Chunked {
+		r, err := s.openContent(e.Path, e.storage)
+		if err != nil {
+			return nil, err
+		}
+		return newReaderBlob(s.fullPath(e.Path), r, e.Size, r), nil
+	}
+	m, err := s.readManifest(e.Path)
+	if err != nil {
+		return nil, err
+	}
+	r := newChunkReader(s, m)
+	return newReaderBlob(s.fullPath(e.Path), r, m.Size, r), nil
+}
+
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openContent opens the file at pth, decrypting and decoding it as described by st
+func (s *BlobStore) openContent(pth string, st storage) (readerAtCloser, error) {
+	f, size, err := s.openRaw(pth, st)
+	if err != nil {
+		return nil, err
+	}
+	var r readerAtCloser = f
+	if st.KeyID != "" {
+		if s.config.KeyProvider == nil {
+			f.Close()
+			return nil, fmt.Errorf("%s is encrypted with key '%s' and no key provider is configured", pth, st.KeyID)
+		}
+		d, err := newDecryptReader(f, size, s.config.KeyProvider)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = d
+		size = d.size
+	}
+	if st.Codec == "" {
+		return r, nil
+	}
+	c, err := lookupCodec(st.Codec)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return newCodecReader(r, size, c), nil
+}
+
+// openRaw opens the stored bytes of the content at pth, from its file or
+// its pack segment
+func (s *BlobStore) openRaw(pth string, st storage) (readerAtCloser, int64, error) {
+	if st.Packed {
+		return s.packs.open(pth)
+	}
+	f, err := os.Open(s.fullPath(pth))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// contentExists reports whether the content at pth, stored as st, is present
+func (s *BlobStore) contentExists(pth string, st storage) bool {
+	if st.Packed {
+		return s.packs.has(pth)
+	}
+	_, err := os.Stat(s.fullPath(pth))
+	return err == nil
 }
 
 func (s *BlobStore) fullPath(p string) string {
@@ -196,11 +1010,18 @@ func (s *BlobStore) relPath(p string) string {
 
 }
 
-// path is the resolved path in the blob store, not the key
+// path is the resolved path in the blob store, not the key. packed
+// content is described by its location in the pack
 func (s *BlobStore) Stat(path string) (fs.FileInfo, error) {
 	fp := s.fullPath(path)
 	s.config.Logger.Sugar().Infof("stat %s", fp)
-	return os.Stat(fp)
+	info, err := os.Stat(fp)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		if loc, ok := s.packs.stat(s.relPath(fp)); ok {
+			return &BlobInfo{name: filepath.Base(fp), size: loc.Length, modTime: loc.Added}, nil
+		}
+	}
+	return info, err
 }
 
 // path is the resolved path in the blob store, not the key
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -160,3 +163,130 @@ func TestBlobStore_Remove(t *testing.T) {
 	assert.Len(t, dirEnts, 0)
 
 }
+
+func TestBlobStore_Dedup(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	content := []byte("shared content")
+	putBlob(t, s, "key1", content)
+	putBlob(t, s, "key2", content)
+
+	e1, ok := s.blobMap.Get("key1")
+	require.True(t, ok)
+	e2, ok := s.blobMap.Get("key2")
+	require.True(t, ok)
+	assert.Equal(t, e1.Path, e2.Path)
+	assert.Equal(t, 2, s.blobMap.Refs(e1.Path))
+
+	stats := s.Stats()
+	assert.Equal(t, Stats{
+		Keys:          2,
+		Objects:       1,
+		LogicalBytes:  2 * int64(len(content)),
+		PhysicalBytes: int64(len(content)),
+	}, stats)
+	assert.Equal(t, int64(len(content)), stats.SavedBytes())
+
+	// removing one key keeps the content for the other
+	require.NoError(t, s.Remove("key1"))
+	got, err := s.ReadFile("key2")
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// overwriting the last reference releases the old content
+	putBlob(t, s, "key2", []byte("new content"))
+	_, err = s.Stat(e1.Path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, 0, s.blobMap.Refs(e1.Path))
+
+	require.NoError(t, s.Remove("key2"))
+	assert.Equal(t, Stats{}, s.Stats())
+}
+
+func TestBlobStore_Open(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	content := []byte("0123456789abcdef")
+	putBlob(t, s, "key", content)
+
+	f, err := s.Open("key")
+	require.NoError(t, err)
+
+	got, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	buf := make([]byte, 4)
+	n, err := f.(io.ReaderAt).ReadAt(buf, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, content[10:14], buf[:n])
+
+	off, err := f.(io.Seeker).Seek(-6, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), off)
+
+	out := new(bytes.Buffer)
+	wn, err := f.(io.WriterTo).WriteTo(out)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), wn)
+	assert.Equal(t, content[10:], out.Bytes())
+
+	assert.NoError(t, f.Close())
+	assert.Error(t, f.Close())
+}
+
+func TestBlobStore_Stat(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:          t.TempDir(),
+		Logger:        zap.Must(zap.NewDevelopment()),
+		HashAlgorithm: SHA512,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	content := []byte("some content")
+	start := time.Now()
+	b, err := s.Create("key")
+	require.NoError(t, err)
+	_, err = b.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	h, err := SHA512.New()
+	require.NoError(t, err)
+	h.Write(content)
+	want := DigestOf(h)
+
+	check := func(info fs.FileInfo) {
+		t.Helper()
+		assert.Equal(t, int64(len(content)), info.Size())
+		assert.False(t, info.ModTime().Before(start.Truncate(time.Second)))
+		sys, ok := info.Sys().(*BlobSys)
+		require.True(t, ok)
+		assert.Equal(t, "key", sys.Key)
+		assert.Equal(t, SHA512, sys.Algorithm)
+		assert.True(t, want.Equal(sys.Digest))
+	}
+
+	info, err := b.Stat()
+	require.NoError(t, err)
+	check(info)
+
+	f, err := s.Open("key")
+	require.NoError(t, err)
+	defer f.Close()
+	openInfo, err := f.Stat()
+	require.NoError(t, err)
+	check(openInfo)
+	assert.True(t, info.ModTime().Equal(openInfo.ModTime()))
+}
@@ -0,0 +1,563 @@
+package store
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultCacheMaxBytes      = 64 * 1024 * 1024
+	DefaultCacheMaxObjectSize = 4 * 1024 * 1024
+	DefaultCacheDiskMaxBytes  = 1024 * 1024 * 1024
+)
+
+// CacheConfig configures a CachedFS
+type CacheConfig struct {
+	// MaxBytes bounds the memory tier. defaults to 64MiB
+	MaxBytes int64
+	// MaxObjectSize is the largest object that is cached, larger objects
+	// are always read from the backend. defaults to 4MiB
+	MaxObjectSize int64
+	// DiskDir enables a local disk tier in this dir when set. objects
+	// evicted from memory are kept there until it is full. the dir is
+	// emptied when the cache is created
+	DiskDir string
+	// DiskMaxBytes bounds the disk tier. defaults to 1GiB
+	DiskMaxBytes int64
+	Logger       *zap.Logger
+}
+
+// CacheStats counts the reads served by a CachedFS
+type CacheStats struct {
+	// Hits are reads served from memory, DiskHits from the disk tier
+	Hits     int64
+	DiskHits int64
+	// Misses are reads of cacheable objects that went to the backend
+	Misses int64
+	// Bypassed are reads of objects too large to cache
+	Bypassed int64
+	// Evictions from memory, and DiskEvictions from the disk tier
+	Evictions     int64
+	DiskEvictions int64
+	// Invalidations are cached objects dropped by a write or remove
+	Invalidations int64
+	// Entries and Bytes in memory, DiskEntries and DiskBytes on disk
+	Entries     int
+	Bytes       int64
+	DiskEntries int
+	DiskBytes   int64
+}
+
+// HitRatio is the fraction of cacheable reads served by either tier
+func (s CacheStats) HitRatio() float64 {
+	total := s.Hits + s.DiskHits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits+s.DiskHits) / float64(total)
+}
+
+// CachedFS is a read through cache of the keys of a ReadWriteStatFS.
+// writes and removes go to the backend and invalidate the cached key. Stat
+// and ReadDir operate on content paths and are not cached
+type CachedFS struct {
+	backend ReadWriteStatFS
+	config  CacheConfig
+
+	mu   sync.Mutex
+	mem  *lru
+	disk *lru
+	// gen is bumped when a key is invalidated while it is read from the
+	// backend, so a read that raced with a write doesn't cache stale
+	// content. loads counts those reads, a key's gen is dropped with them
+	gen   map[string]uint64
+	loads map[string]int
+	stats CacheStats
+}
+
+var _ ReadWriteStatFS = (*CachedFS)(nil)
+var _ Copier = (*CachedFS)(nil)
+var _ Uploader = (*CachedFS)(nil)
+
+func NewCachedFS(backend ReadWriteStatFS, config CacheConfig) (*CachedFS, error) {
+	if config.MaxBytes == 0 {
+		config.MaxBytes = DefaultCacheMaxBytes
+	}
+	if config.MaxObjectSize == 0 {
+		config.MaxObjectSize = DefaultCacheMaxObjectSize
+	}
+	if config.MaxObjectSize > config.MaxBytes {
+		config.MaxObjectSize = config.MaxBytes
+	}
+	if config.DiskMaxBytes == 0 {
+		config.DiskMaxBytes = DefaultCacheDiskMaxBytes
+	}
+	if config.MaxBytes < 0 || config.MaxObjectSize < 0 || config.DiskMaxBytes < 0 {
+		return nil, fmt.Errorf("invalid cache sizes: memory %d object %d disk %d",
+			config.MaxBytes, config.MaxObjectSize, config.DiskMaxBytes)
+	}
+	if config.Logger == nil {
+		var err error
+		config.Logger, err = zap.NewDevelopment()
+		if err != nil {
+			return nil, err
+		}
+	}
+	config.Logger = config.Logger.Named("CachedFS")
+	c := &CachedFS{
+		backend: backend,
+		config:  config,
+		gen:     make(map[string]uint64),
+		loads:   make(map[string]int),
+	}
+	c.mem = newLRU(config.MaxBytes, c.demote)
+	if config.DiskDir != "" {
+		err := os.RemoveAll(config.DiskDir)
+		if err == nil {
+			err = os.MkdirAll(config.DiskDir, 0755)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.disk = newLRU(config.DiskMaxBytes, c.dropDisk)
+	}
+	return c, nil
+}
+
+// cacheEntry is a cached object. data is set in memory, path on disk
+type cacheEntry struct {
+	key  string
+	info fs.FileInfo
+	size int64
+	data []byte
+	path string
+}
+
+// expired reports whether the key of e has expired at now, if the backend
+// reports expiry
+func (e *cacheEntry) expired(now time.Time) bool {
+	sys, ok := e.info.Sys().(*BlobSys)
+	return ok && sys.Meta.expired(now)
+}
+
+// Stats returns the counters and current size of the cache
+func (c *CachedFS) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.stats
+	out.Entries, out.Bytes = c.mem.len(), c.mem.bytes
+	if c.disk != nil {
+		out.DiskEntries, out.DiskBytes = c.disk.len(), c.disk.bytes
+	}
+	return out
+}
+
+func (c *CachedFS) Open(key string) (fs.File, error) {
+	e, f, err := c.load(key)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		return f, nil
+	}
+	return &cachedFile{Reader: bytes.NewReader(e.data), info: e.info}, nil
+}
+
+func (c *CachedFS) ReadFile(key string) ([]byte, error) {
+	e, f, err := c.load(key)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	return append([]byte(nil), e.data...), nil
+}
+
+// load returns the cached entry of key, reading it from the backend on a
+// miss. objects too large to cache are returned as the open backend file
+func (c *CachedFS) load(key string) (*cacheEntry, fs.File, error) {
+	c.mu.Lock()
+	now := time.Now()
+	if e, ok := c.mem.get(key); ok {
+		if !e.expired(now) {
+			c.stats.Hits++
+			c.mu.Unlock()
+			return e, nil, nil
+		}
+		c.invalidate(key)
+	}
+	if c.disk != nil {
+		if e, ok := c.disk.get(key); ok && e.expired(now) {
+			c.invalidate(key)
+		} else if ok {
+			data, err := os.ReadFile(e.path)
+			if err == nil {
+				c.stats.DiskHits++
+				c.disk.remove(key)
+				mem := &cacheEntry{key: key, info: e.info, size: e.size, data: data}
+				c.mem.add(mem)
+				c.mu.Unlock()
+				return mem, nil, nil
+			}
+			c.config.Logger.Sugar().Warnf("dropping unreadable disk cache entry %s: %v", e.path, err)
+			c.disk.remove(key)
+		}
+	}
+	gen := c.gen[key]
+	c.loads[key]++
+	c.mu.Unlock()
+	defer c.loaded(key)
+
+	f, err := c.backend.Open(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.Size() > c.config.MaxObjectSize {
+		c.mu.Lock()
+		c.stats.Bypassed++
+		c.mu.Unlock()
+		return nil, f, nil
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	e := &cacheEntry{key: key, info: info, size: int64(len(data)), data: data}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Misses++
+	if c.gen[key] == gen {
+		c.mem.add(e)
+	}
+	return e, nil, nil
+}
+
+// loaded ends a read of key from the backend
+func (c *CachedFS) loaded(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loads[key]--
+	if c.loads[key] == 0 {
+		delete(c.loads, key)
+		delete(c.gen, key)
+	}
+}
+
+// invalidate drops key from both tiers. c.mu must be held
+func (c *CachedFS) invalidate(key string) {
+	if c.loads[key] > 0 {
+		c.gen[key]++
+	}
+	dropped := c.mem.remove(key)
+	if c.disk != nil && c.disk.remove(key) {
+		dropped = true
+	}
+	if dropped {
+		c.stats.Invalidations++
+	}
+}
+
+// demote moves an entry evicted from memory to the disk tier. c.mu is held
+func (c *CachedFS) demote(e *cacheEntry) {
+	c.stats.Evictions++
+	if c.disk == nil || e.size > c.config.DiskMaxBytes {
+		return
+	}
+	c.disk.remove(e.key)
+	sum := sha256.Sum256([]byte(e.key))
+	p := filepath.Join(c.config.DiskDir, hex.EncodeToString(sum[:]))
+	err := writeFileAtomic(p, e.data, DurabilityNone)
+	if err != nil {
+		c.config.Logger.Sugar().Warnf("failed to write disk cache entry for '%s': %v", e.key, err)
+		return
+	}
+	c.disk.add(&cacheEntry{key: e.key, info: e.info, size: e.size, path: p})
+}
+
+// dropDisk deletes an entry that left the disk tier. c.mu is held
+func (c *CachedFS) dropDisk(e *cacheEntry) {
+	c.stats.DiskEvictions++
+	err := os.Remove(e.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.config.Logger.Sugar().Warnf("failed to remove disk cache entry %s: %v", e.path, err)
+	}
+}
+
+func (c *CachedFS) Create(key string) (WriteFile, error) {
+	w, err := c.backend.Create(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(key, w), nil
+}
+
+// CreateWith is Create with options, if the backend supports them
+func (c *CachedFS) CreateWith(key string, opts ...CreateOpt) (WriteFile, error) {
+	b, ok := c.backend.(interface {
+		CreateWith(string, ...CreateOpt) (WriteFile, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("backend %T doesn't support create options", c.backend)
+	}
+	w, err := b.CreateWith(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(key, w), nil
+}
+
+func (c *CachedFS) wrap(key string, w WriteFile) WriteFile {
+	c.mu.Lock()
+	c.invalidate(key)
+	c.mu.Unlock()
+	return &cachedWriter{WriteFile: w, c: c, key: key}
+}
+
+// Remove deletes key from the backend and the cache
+func (c *CachedFS) Remove(key string) error {
+	err := c.backend.Remove(key)
+	c.mu.Lock()
+	c.invalidate(key)
+	c.mu.Unlock()
+	return err
+}
+
+// Copy copies src to dst in the backend, if it supports it
+func (c *CachedFS) Copy(src string, dst string) error {
+	b, ok := c.backend.(Copier)
+	if !ok {
+		return fmt.Errorf("backend %T doesn't support copies", c.backend)
+	}
+	err := b.Copy(src, dst)
+	c.mu.Lock()
+	c.invalidate(dst)
+	c.mu.Unlock()
+	return err
+}
+
+// Rename renames src to dst in the backend, if it supports it
+func (c *CachedFS) Rename(src string, dst string) error {
+	b, ok := c.backend.(Copier)
+	if !ok {
+		return fmt.Errorf("backend %T doesn't support renames", c.backend)
+	}
+	err := b.Rename(src, dst)
+	c.mu.Lock()
+	c.invalidate(src)
+	c.invalidate(dst)
+	c.mu.Unlock()
+	return err
+}
+
+// uploader is the backend as an Uploader
+func (c *CachedFS) uploader() (Uploader, error) {
+	u, ok := c.backend.(Uploader)
+	if !ok {
+		return nil, fmt.Errorf("%w: backend %T doesn't support uploads", ErrUnsupported, c.backend)
+	}
+	return u, nil
+}
+
+// BeginUpload begins an upload in the backend, if it supports it
+func (c *CachedFS) BeginUpload(key string, opts ...CreateOpt) (string, error) {
+	u, err := c.uploader()
+	if err != nil {
+		return "", err
+	}
+	return u.BeginUpload(key, opts...)
+}
+
+func (c *CachedFS) AppendUpload(id string, offset int64, r io.Reader) (int64, error) {
+	u, err := c.uploader()
+	if err != nil {
+		return 0, err
+	}
+	return u.AppendUpload(id, offset, r)
+}
+
+func (c *CachedFS) UploadStatus(id string) (UploadStatus, error) {
+	u, err := c.uploader()
+	if err != nil {
+		return UploadStatus{}, err
+	}
+	return u.UploadStatus(id)
+}
+
+func (c *CachedFS) ListUploads() ([]UploadStatus, error) {
+	u, err := c.uploader()
+	if err != nil {
+		return nil, err
+	}
+	return u.ListUploads()
+}
+
+// CompleteUpload completes the upload in the backend and invalidates its key
+func (c *CachedFS) CompleteUpload(id string) (fs.FileInfo, error) {
+	u, err := c.uploader()
+	if err != nil {
+		return nil, err
+	}
+	st, err := u.UploadStatus(id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := u.CompleteUpload(id)
+	c.mu.Lock()
+	c.invalidate(st.Key)
+	c.mu.Unlock()
+	return info, err
+}
+
+func (c *CachedFS) AbortUpload(id string) error {
+	u, err := c.uploader()
+	if err != nil {
+		return err
+	}
+	return u.AbortUpload(id)
+}
+
+// path is the resolved path in the backend, not the key
+func (c *CachedFS) Stat(path string) (fs.FileInfo, error) {
+	return c.backend.Stat(path)
+}
+
+// path is the resolved path in the backend, not the key
+func (c *CachedFS) ReadDir(path string) ([]fs.DirEntry, error) {
+	return c.backend.ReadDir(path)
+}
+
+// cachedWriter invalidates the key again once the write is committed, in
+// case it was read while being written
+type cachedWriter struct {
+	WriteFile
+	c   *CachedFS
+	key string
+}
+
+func (w *cachedWriter) Close() error {
+	err := w.WriteFile.Close()
+	w.c.mu.Lock()
+	w.c.invalidate(w.key)
+	w.c.mu.Unlock()
+	return err
+}
+
+// Abort aborts the backend writer, if it can be
+func (w *cachedWriter) Abort() error {
+	a, ok := w.WriteFile.(Aborter)
+	if !ok {
+		return fmt.Errorf("writer %T can't be aborted", w.WriteFile)
+	}
+	return a.Abort()
+}
+
+// cachedFile reads a cached object
+type cachedFile struct {
+	*bytes.Reader
+	info   fs.FileInfo
+	closed bool
+}
+
+var _ io.ReaderAt = (*cachedFile)(nil)
+var _ io.Seeker = (*cachedFile)(nil)
+
+func (f *cachedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *cachedFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// lru is a size bounded least recently used set of entries. it is not
+// safe for concurrent use
+type lru struct {
+	max     int64
+	bytes   int64
+	order   *list.List
+	entries map[string]*list.Element
+	// onEvict is called with entries pushed out by adds
+	onEvict func(*cacheEntry)
+}
+
+func newLRU(max int64, onEvict func(*cacheEntry)) *lru {
+	return &lru{
+		max:     max,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		onEvict: onEvict,
+	}
+}
+
+func (l *lru) len() int {
+	return len(l.entries)
+}
+
+func (l *lru) get(key string) (*cacheEntry, bool) {
+	el, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+// add inserts e as the most recently used entry, evicting the least
+// recently used entries to make room
+func (l *lru) add(e *cacheEntry) {
+	l.remove(e.key)
+	if e.size > l.max {
+		return
+	}
+	for l.bytes+e.size > l.max {
+		el := l.order.Back()
+		old := el.Value.(*cacheEntry)
+		l.order.Remove(el)
+		delete(l.entries, old.key)
+		l.bytes -= old.size
+		l.onEvict(old)
+	}
+	l.entries[e.key] = l.order.PushFront(e)
+	l.bytes += e.size
+}
+
+// remove drops key, reporting whether it was there. disk entries are deleted
+func (l *lru) remove(key string) bool {
+	el, ok := l.entries[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*cacheEntry)
+	l.order.Remove(el)
+	delete(l.entries, key)
+	l.bytes -= e.size
+	if e.path != "" {
+		os.Remove(e.path)
+	}
+	return true
+}
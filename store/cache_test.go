@@ -0,0 +1,167 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// countingFS counts the opens that reach the backend
+type countingFS struct {
+	ReadWriteStatFS
+	opens int64
+}
+
+func (c *countingFS) Open(key string) (fs.File, error) {
+	atomic.AddInt64(&c.opens, 1)
+	return c.ReadWriteStatFS.Open(key)
+}
+
+func TestCachedFS(t *testing.T) {
+	mem, err := NewMemStore(MemStoreConfig{})
+	require.NoError(t, err)
+	backend := &countingFS{ReadWriteStatFS: mem}
+	diskDir := t.TempDir()
+	c, err := NewCachedFS(backend, CacheConfig{
+		MaxBytes:      250,
+		MaxObjectSize: 100,
+		DiskDir:       diskDir,
+		DiskMaxBytes:  200,
+		Logger:        zap.NewNop(),
+	})
+	require.NoError(t, err)
+
+	put := func(key string, data []byte) {
+		w, err := c.Create(key)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	read := func(key string, want []byte) {
+		t.Helper()
+		got, err := c.ReadFile(key)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, key)
+	}
+
+	a := bytes.Repeat([]byte("a"), 100)
+	put("a", a)
+	read("a", a)
+	read("a", a)
+	assert.Equal(t, int64(1), backend.opens)
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, int64(100), stats.Bytes)
+
+	// opened files are served from the cache, with the backend's info
+	f, err := c.Open("a")
+	require.NoError(t, err)
+	info, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, "a", info.Sys().(*BlobSys).Key)
+	got, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, a, got)
+	require.NoError(t, f.Close())
+	assert.Equal(t, int64(1), backend.opens)
+
+	// overwrite and remove invalidate
+	a2 := bytes.Repeat([]byte("A"), 100)
+	put("a", a2)
+	read("a", a2)
+	assert.Equal(t, int64(2), backend.opens)
+	require.NoError(t, c.Remove("a"))
+	_, err = c.ReadFile("a")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Equal(t, int64(2), c.Stats().Invalidations)
+
+	// least recently used objects are demoted to disk, and promoted back on a hit
+	b := bytes.Repeat([]byte("b"), 100)
+	d := bytes.Repeat([]byte("d"), 100)
+	e := bytes.Repeat([]byte("e"), 100)
+	put("b", b)
+	put("d", d)
+	put("e", e)
+	read("b", b)
+	read("d", d)
+	read("e", e)
+	stats = c.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 1, stats.DiskEntries)
+	assert.Equal(t, int64(1), stats.Evictions)
+	ents, err := os.ReadDir(diskDir)
+	require.NoError(t, err)
+	assert.Len(t, ents, 1)
+	opens := backend.opens
+	read("b", b)
+	assert.Equal(t, opens, backend.opens)
+	assert.Equal(t, int64(1), c.Stats().DiskHits)
+
+	// objects too large to cache always go to the backend
+	big := bytes.Repeat([]byte("x"), 101)
+	put("big", big)
+	read("big", big)
+	read("big", big)
+	assert.Equal(t, opens+2, backend.opens)
+	assert.Equal(t, int64(2), c.Stats().Bypassed)
+	assert.Greater(t, c.Stats().HitRatio(), 0.0)
+	// only reads in flight need a generation
+	assert.Empty(t, c.gen)
+	assert.Empty(t, c.loads)
+}
+
+func TestCachedFS_Expiry(t *testing.T) {
+	mem, err := NewMemStore(MemStoreConfig{})
+	require.NoError(t, err)
+	// room for one object in memory, the other is demoted to disk
+	c, err := NewCachedFS(mem, CacheConfig{MaxBytes: 8, DiskDir: t.TempDir(), Logger: zap.NewNop()})
+	require.NoError(t, err)
+
+	for _, key := range []string{"disk", "mem"} {
+		w, err := c.CreateWith(key, WithExpiry(time.Now().Add(100*time.Millisecond)))
+		require.NoError(t, err)
+		_, err = w.Write([]byte("expiring"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		_, err = c.ReadFile(key)
+		require.NoError(t, err)
+	}
+	stats := c.Stats()
+	require.Equal(t, 1, stats.Entries)
+	require.Equal(t, 1, stats.DiskEntries)
+
+	// hits in either tier expire with the key
+	time.Sleep(100 * time.Millisecond)
+	for _, key := range []string{"mem", "disk"} {
+		_, err = c.ReadFile(key)
+		assert.ErrorIs(t, err, fs.ErrNotExist, key)
+	}
+	stats = c.Stats()
+	assert.Equal(t, 0, stats.Entries)
+	assert.Equal(t, 0, stats.DiskEntries)
+}
+
+func TestCachedFS_Conformance(t *testing.T) {
+	testReadWriteStatFS(t, func(t *testing.T) ReadWriteStatFS {
+		s, err := NewBlobStore(BlobStoreConfig{
+			Root:   t.TempDir(),
+			Logger: zap.NewNop(),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		c, err := NewCachedFS(s, CacheConfig{Logger: zap.NewNop()})
+		require.NoError(t, err)
+		return c
+	})
+}
@@ -0,0 +1,455 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// chunkManifest is stored at the content path of a chunked blob. it lists
+// the content addressed chunks that make up the content, in order
+type chunkManifest struct {
+	Size   int64           `json:"size"`
+	Chunks []manifestChunk `json:"chunks"`
+}
+
+type manifestChunk struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Codec, KeyID and StoredSize are set if the chunk is compressed
+	// and/or encrypted
+	Codec      string `json:"codec,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+	StoredSize int64  `json:"stored_size,omitempty"`
+	// Packed is set if the chunk is also the whole content of a key that
+	// was packed
+	Packed bool `json:"packed,omitempty"`
+}
+
+func (c manifestChunk) storage() storage {
+	return storage{Codec: c.Codec, KeyID: c.KeyID, StoredSize: c.StoredSize, Packed: c.Packed}
+}
+
+func (c manifestChunk) storedSize() int64 {
+	if c.StoredSize != 0 {
+		return c.StoredSize
+	}
+	return c.Size
+}
+
+// chunkRef counts the manifests referencing a chunk
+type chunkRef struct {
+	refs int
+	manifestChunk
+}
+
+// storeChunks splits the staged file into chunks, stores any chunks that
+// aren't already stored and stages a manifest in place of the staged file.
+// an empty path is returned if the content isn't worth chunking, in which
+// case the staged file is left alone. chunks are encoded without s.mu, and
+// pinned until the manifest references them, so that they aren't released
+// or collected meanwhile. the pinned chunks are returned
+func (s *BlobStore) storeChunks(staged string) (_ string, pinned []string, err error) {
+	f, err := os.Open(staged)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	defer func() {
+		if err != nil {
+			s.unpin(pinned)
+			pinned = nil
+		}
+	}()
+
+	m := &chunkManifest{
+		Chunks: make([]manifestChunk, 0),
+	}
+	c := newChunker(f, *s.config.Chunking)
+	for {
+		var data []byte
+		data, err = c.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return "", pinned, err
+		}
+		if len(m.Chunks) == 0 && c.eof && c.start == c.end {
+			// a single chunk is the whole content
+			return "", pinned, nil
+		}
+		h, err := s.config.HashAlgorithm.New()
+		if err != nil {
+			return "", pinned, err
+		}
+		h.Write(data)
+		chunk := manifestChunk{Path: s.config.PathFunc(h), Size: int64(len(data))}
+		m.Size += chunk.Size
+
+		s.mu.Lock()
+		st, ok := s.storedAs(chunk.Path)
+		if ok {
+			s.pin([]string{chunk.Path})
+		}
+		s.mu.Unlock()
+		if ok {
+			// already stored, possibly encoded differently
+			pinned = append(pinned, chunk.Path)
+			chunk.stored(st)
+			m.Chunks = append(m.Chunks, chunk)
+			continue
+		}
+		if s.config.Codec != nil {
+			enc, ok, err := encode(s.config.Codec, data)
+			if err != nil {
+				return "", pinned, err
+			}
+			if ok {
+				data = enc
+				chunk.Codec = s.config.Codec.Name()
+				chunk.StoredSize = int64(len(enc))
+			}
+		}
+		if s.config.KeyProvider != nil {
+			enc, keyID, err := encryptBytes(s.config.KeyProvider, data)
+			if err != nil {
+				return "", pinned, err
+			}
+			data = enc
+			chunk.KeyID = keyID
+			chunk.StoredSize = int64(len(enc))
+		}
+		s.mu.Lock()
+		err = s.placeChunk(&chunk, data)
+		s.mu.Unlock()
+		if err != nil {
+			return "", pinned, err
+		}
+		pinned = append(pinned, chunk.Path)
+		m.Chunks = append(m.Chunks, chunk)
+	}
+	if len(m.Chunks) <= 1 {
+		return "", pinned, nil
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", pinned, err
+	}
+	mf, err := os.CreateTemp(s.journal.stagingDir(), "blob-*")
+	if err != nil {
+		return "", pinned, err
+	}
+	_, err = mf.Write(data)
+	if err == nil && s.config.Durability.syncFiles() {
+		err = mf.Sync()
+	}
+	if cerr := mf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(mf.Name())
+		return "", pinned, err
+	}
+	f.Close()
+	err = os.Remove(staged)
+	if err != nil {
+		os.Remove(mf.Name())
+		return "", pinned, err
+	}
+	return mf.Name(), pinned, nil
+}
+
+// placeChunk writes the encoded data of chunk to its path and pins it,
+// unless the chunk was stored by another commit since it was encoded.
+// s.mu must be held
+func (s *BlobStore) placeChunk(chunk *manifestChunk, data []byte) error {
+	if st, ok := s.storedAs(chunk.Path); ok {
+		chunk.stored(st)
+	} else {
+		fp := s.fullPath(chunk.Path)
+		err := os.MkdirAll(filepath.Dir(fp), 0755)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(fp, data, s.config.Durability)
+		if err != nil {
+			return err
+		}
+	}
+	s.pin([]string{chunk.Path})
+	return nil
+}
+
+// stored sets how the chunk is stored to st
+func (c *manifestChunk) stored(st storage) {
+	c.Codec = st.Codec
+	c.KeyID = st.KeyID
+	c.StoredSize = st.StoredSize
+	c.Packed = st.Packed
+}
+
+// repairChunks rewrites chunks of the manifest at pth that are missing, eg
+// because the scrubber quarantined them, from the staged content. chunks
+// are written with the encoding recorded in the manifest. s.mu must be held
+func (s *BlobStore) repairChunks(pth string, staged string) error {
+	m, err := s.readManifest(pth)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	off := int64(0)
+	for _, c := range m.Chunks {
+		start := off
+		off += c.Size
+		if s.contentExists(c.Path, c.storage()) {
+			continue
+		}
+		s.config.Logger.Sugar().Infof("repairing chunk %s of %s", c.Path, pth)
+		data := make([]byte, c.Size)
+		_, err := f.ReadAt(data, start)
+		if err != nil {
+			return err
+		}
+		data, err = s.encodeChunk(data, c.storage())
+		if err != nil {
+			return err
+		}
+		if c.Packed {
+			err = s.packs.putBytes(c.Path, data)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		fp := s.fullPath(c.Path)
+		err = os.MkdirAll(filepath.Dir(fp), 0755)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(fp, data, s.config.Durability)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeChunk encodes data as described by st
+func (s *BlobStore) encodeChunk(data []byte, st storage) ([]byte, error) {
+	if st.Codec != "" {
+		c, err := lookupCodec(st.Codec)
+		if err != nil {
+			return nil, err
+		}
+		buf := new(bytes.Buffer)
+		w, err := c.NewWriter(buf)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	if st.KeyID != "" {
+		if s.config.KeyProvider == nil {
+			return nil, fmt.Errorf("chunk is encrypted with key '%s' and no key provider is configured", st.KeyID)
+		}
+		key, err := s.config.KeyProvider.Key(st.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		buf := new(bytes.Buffer)
+		err = encryptWithKey(st.KeyID, key, buf, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	return data, nil
+}
+
+func (s *BlobStore) readManifest(pth string) (*chunkManifest, error) {
+	data, err := os.ReadFile(s.fullPath(pth))
+	if err != nil {
+		return nil, err
+	}
+	m := &chunkManifest{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// retainChunks references the chunks of the manifest at pth. s.mu must be held
+func (s *BlobStore) retainChunks(pth string) error {
+	m, err := s.readManifest(pth)
+	if err != nil {
+		return err
+	}
+	for _, c := range m.Chunks {
+		ref, ok := s.chunks[c.Path]
+		if !ok {
+			ref = &chunkRef{manifestChunk: c}
+			s.chunks[c.Path] = ref
+		}
+		ref.refs++
+	}
+	return nil
+}
+
+// releaseChunks drops the references of the manifest at pth and deletes
+// chunks nothing references anymore. s.mu must be held
+func (s *BlobStore) releaseChunks(pth string) error {
+	m, err := s.readManifest(pth)
+	if err != nil {
+		return err
+	}
+	for _, c := range m.Chunks {
+		ref, ok := s.chunks[c.Path]
+		if !ok {
+			continue
+		}
+		ref.refs--
+		if ref.refs > 0 {
+			continue
+		}
+		delete(s.chunks, c.Path)
+		if s.blobMap.Refs(c.Path) > 0 || s.pins[c.Path] > 0 {
+			// the chunk is also the whole content of some key, which
+			// releases it once unreferenced
+			continue
+		}
+		err = s.removeStored(c.Path, c.storage())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadChunkRefs derives chunk references from the manifests in the index
+func (s *BlobStore) loadChunkRefs() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, e := range s.blobMap.Values() {
+		if !e.Chunked || seen[e.Path] {
+			continue
+		}
+		seen[e.Path] = true
+		err := s.retainChunks(e.Path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkReader reassembles chunked content. one chunk file is kept open at a time
+type chunkReader struct {
+	s       *BlobStore
+	m       *chunkManifest
+	offsets []int64
+
+	mu  sync.Mutex
+	cur int
+	f   readerAtCloser
+}
+
+var _ io.ReaderAt = (*chunkReader)(nil)
+
+func newChunkReader(s *BlobStore, m *chunkManifest) *chunkReader {
+	offsets := make([]int64, len(m.Chunks))
+	off := int64(0)
+	for i, c := range m.Chunks {
+		offsets[i] = off
+		off += c.Size
+	}
+	return &chunkReader{
+		s:       s,
+		m:       m,
+		offsets: offsets,
+		cur:     -1,
+	}
+}
+
+func (r *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	read := 0
+	for read < len(p) && off < r.m.Size {
+		i := sort.Search(len(r.offsets), func(i int) bool {
+			return r.offsets[i] > off
+		}) - 1
+		f, err := r.chunk(i)
+		if err != nil {
+			return read, err
+		}
+		want := len(p) - read
+		if rest := r.offsets[i] + r.m.Chunks[i].Size - off; int64(want) > rest {
+			want = int(rest)
+		}
+		n, err := f.ReadAt(p[read:read+want], off-r.offsets[i])
+		read += n
+		off += int64(n)
+		if n < want {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return read, err
+		}
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (r *chunkReader) chunk(i int) (io.ReaderAt, error) {
+	if r.cur == i {
+		return r.f, nil
+	}
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	c := r.m.Chunks[i]
+	f, err := r.s.openContent(c.Path, c.storage())
+	if err != nil {
+		return nil, err
+	}
+	r.f = f
+	r.cur = i
+	return f, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	r.cur = -1
+	return err
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_Chunked(t *testing.T) {
+	config := BlobStoreConfig{
+		Root:     t.TempDir(),
+		Logger:   zap.Must(zap.NewDevelopment()),
+		Chunking: &ChunkingConfig{MinSize: 1024, AvgSize: 4096, MaxSize: 16384},
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+
+	v1 := randBytes(2, 256*1024)
+	v2 := append(append([]byte(nil), v1...), []byte("appended to version 2")...)
+	copy(v2[1000:], []byte("edited"))
+	small := []byte("too small to chunk")
+
+	putBlob(t, s, "v1", v1)
+	putBlob(t, s, "v2", v2)
+	putBlob(t, s, "small", small)
+
+	e1, _ := s.blobMap.Get("v1")
+	e2, _ := s.blobMap.Get("v2")
+	es, _ := s.blobMap.Get("small")
+	assert.True(t, e1.Chunked)
+	assert.True(t, e2.Chunked)
+	assert.False(t, es.Chunked)
+
+	check := func(s *BlobStore) {
+		t.Helper()
+		for key, want := range map[string][]byte{"v1": v1, "v2": v2, "small": small} {
+			got, err := s.ReadFile(key)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got, key)
+		}
+		f, err := s.Open("v2")
+		require.NoError(t, err)
+		defer f.Close()
+		buf := make([]byte, 100)
+		n, err := f.(io.ReaderAt).ReadAt(buf, int64(len(v2)-50))
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Equal(t, v2[len(v2)-50:], buf[:n])
+		info, err := f.Stat()
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(v2)), info.Size())
+	}
+	check(s)
+
+	// the versions share most of their chunks
+	stats := s.Stats()
+	assert.Equal(t, int64(len(v1)+len(v2)+len(small)), stats.LogicalBytes)
+	assert.Less(t, stats.PhysicalBytes, int64(len(v1)+len(v1)/4))
+
+	// chunk references survive a restart
+	require.NoError(t, s.Close())
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	check(s)
+	assert.Equal(t, stats, s.Stats())
+
+	require.NoError(t, s.Remove("v1"))
+	got, err := s.ReadFile("v2")
+	assert.NoError(t, err)
+	assert.Equal(t, v2, got)
+
+	require.NoError(t, s.Remove("v2"))
+	require.NoError(t, s.Remove("small"))
+	assert.Len(t, s.chunks, 0)
+	assert.Equal(t, Stats{}, s.Stats())
+
+	ents, err := os.ReadDir(config.Root)
+	require.NoError(t, err)
+	for _, ent := range ents {
+		assert.Equal(t, storeDir, ent.Name())
+	}
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	DefaultChunkMinSize = 16 * 1024
+	DefaultChunkAvgSize = 64 * 1024
+	DefaultChunkMaxSize = 256 * 1024
+)
+
+// ChunkingConfig configures content defined chunking. zero values get the defaults
+type ChunkingConfig struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+func (c *ChunkingConfig) setDefaults() error {
+	if c.MinSize == 0 {
+		c.MinSize = DefaultChunkMinSize
+	}
+	if c.AvgSize == 0 {
+		c.AvgSize = DefaultChunkAvgSize
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = DefaultChunkMaxSize
+	}
+	if c.MinSize <= 0 || c.MinSize > c.AvgSize || c.AvgSize > c.MaxSize {
+		return fmt.Errorf("invalid chunk sizes: min %d avg %d max %d", c.MinSize, c.AvgSize, c.MaxSize)
+	}
+	return nil
+}
+
+// gear maps bytes to random values for the rolling hash. it is generated
+// from a fixed seed, chunk boundaries must not change between runs
+var gear [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x666f7265766572)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// chunker splits a stream with FastCDC. before the average size a cut needs
+// more matching bits than after it, which keeps chunk sizes close to the average
+// https://www.usenix.org/conference/atc16/technical-sessions/presentation/xia
+type chunker struct {
+	r      io.Reader
+	config ChunkingConfig
+	maskS  uint64
+	maskL  uint64
+
+	buf []byte
+	// buf[start:end] is unconsumed input
+	start, end int
+	eof        bool
+}
+
+func newChunker(r io.Reader, config ChunkingConfig) *chunker {
+	b := bits.Len(uint(config.AvgSize)) - 1
+	// use the high bits so that a match depends on the last 64 bytes
+	mask := func(n int) uint64 {
+		return ((uint64(1) << n) - 1) << (64 - n)
+	}
+	return &chunker{
+		r:      r,
+		config: config,
+		maskS:  mask(b + 1),
+		maskL:  mask(b - 1),
+		buf:    make([]byte, config.MaxSize),
+	}
+}
+
+// Next returns the next chunk. the slice is only valid until the next call.
+// io.EOF is returned when there are no more chunks
+func (c *chunker) Next() ([]byte, error) {
+	if !c.eof && c.end-c.start < c.config.MaxSize {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	out := c.buf[c.start : c.start+n]
+	c.start += n
+	return out, nil
+}
+
+// cut returns the length of the chunk at the start of data
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.config.MinSize {
+		return n
+	}
+	if n > c.config.MaxSize {
+		n = c.config.MaxSize
+	}
+	normal := c.config.AvgSize
+	if n < normal {
+		normal = n
+	}
+	fp := uint64(0)
+	i := c.config.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
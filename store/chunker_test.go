@@ -0,0 +1,66 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randBytes(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func chunkAll(t *testing.T, data []byte, config ChunkingConfig) [][]byte {
+	t.Helper()
+	c := newChunker(bytes.NewReader(data), config)
+	out := make([][]byte, 0)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return out
+		}
+		require.NoError(t, err)
+		out = append(out, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	config := ChunkingConfig{MinSize: 1024, AvgSize: 4096, MaxSize: 16384}
+	data := randBytes(1, 1024*1024)
+
+	chunks := chunkAll(t, data, config)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for i, c := range chunks {
+		assert.LessOrEqual(t, len(c), config.MaxSize)
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, len(c), config.MinSize)
+		}
+	}
+	avg := len(data) / len(chunks)
+	assert.InDelta(t, config.AvgSize, avg, float64(config.AvgSize)/2)
+
+	// boundaries are content defined, so an insertion near the start
+	// only changes the chunks around it
+	shifted := append(append(append([]byte(nil), data[:5000]...), []byte("inserted")...), data[5000:]...)
+	shiftedChunks := chunkAll(t, shifted, config)
+	seen := make(map[string]bool)
+	for _, c := range chunks {
+		seen[string(c)] = true
+	}
+	shared := 0
+	for _, c := range shiftedChunks {
+		if seen[string(c)] {
+			shared++
+		}
+	}
+	assert.GreaterOrEqual(t, shared, len(chunks)-3)
+
+	assert.Len(t, chunkAll(t, nil, config), 0)
+	assert.Len(t, chunkAll(t, data[:100], config), 1)
+}
@@ -0,0 +1,261 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Codec compresses content at rest. the codec name is recorded with each
+// stored blob, so a codec must stay registered as long as content written
+// with it exists
+type Codec interface {
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(GzipCodec{Level: gzip.DefaultCompression})
+	RegisterCodec(FlateCodec{Level: flate.DefaultCompression})
+}
+
+// RegisterCodec makes c available to decode content by name
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec '%s'", name)
+	}
+	return c, nil
+}
+
+type GzipCodec struct {
+	Level int
+}
+
+func (GzipCodec) Name() string {
+	return "gzip"
+}
+
+func (c GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.Level)
+}
+
+func (GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type FlateCodec struct {
+	Level int
+}
+
+func (FlateCodec) Name() string {
+	return "flate"
+}
+
+func (c FlateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, c.Level)
+}
+
+func (FlateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+const (
+	// content smaller than this isn't worth compressing
+	minCompressSize = 256
+	// compressibleSample is how much content the heuristic looks at
+	compressibleSample = 64 * 1024
+)
+
+// compressible guesses whether content starting with sample will compress,
+// so that already compressed content (media, archives) is stored as is
+func compressible(sample []byte) bool {
+	if len(sample) < minCompressSize {
+		return false
+	}
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return false
+	}
+	w.Write(sample)
+	w.Close()
+	return buf.Len() < len(sample)*9/10
+}
+
+// encode compresses data with c. ok is false if it didn't get smaller
+func encode(c Codec, data []byte) (out []byte, ok bool, err error) {
+	if !compressible(data[:min(len(data), compressibleSample)]) {
+		return nil, false, nil
+	}
+	buf := new(bytes.Buffer)
+	w, err := c.NewWriter(buf)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if buf.Len() >= len(data) {
+		return nil, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+// encodeFile compresses the file at src with c into a new file in dir. an
+// empty path is returned if the content doesn't compress
+func encodeFile(c Codec, src string, dir string, d Durability) (string, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	sample := make([]byte, min(info.Size(), compressibleSample))
+	_, err = io.ReadFull(in, sample)
+	if err != nil {
+		return "", 0, err
+	}
+	if !compressible(sample) {
+		return "", 0, nil
+	}
+	_, err = in.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", 0, err
+	}
+
+	out, err := os.CreateTemp(dir, "blob-*")
+	if err != nil {
+		return "", 0, err
+	}
+	fail := func(err error) (string, int64, error) {
+		out.Close()
+		os.Remove(out.Name())
+		return "", 0, err
+	}
+	w, err := c.NewWriter(out)
+	if err != nil {
+		return fail(err)
+	}
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil && d.syncFiles() {
+		err = out.Sync()
+	}
+	if err != nil {
+		return fail(err)
+	}
+	outInfo, err := out.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if outInfo.Size() >= info.Size() {
+		return fail(nil)
+	}
+	return out.Name(), outInfo.Size(), out.Close()
+}
+
+// codecReader decodes stored content. decoding is sequential, so reading
+// before the current position starts over from the beginning
+type codecReader struct {
+	mu    sync.Mutex
+	src   readerAtCloser
+	size  int64
+	codec Codec
+	r     io.ReadCloser
+	pos   int64
+}
+
+var _ io.ReaderAt = (*codecReader)(nil)
+
+// newCodecReader decodes the size encoded bytes of src
+func newCodecReader(src readerAtCloser, size int64, codec Codec) *codecReader {
+	return &codecReader{
+		src:   src,
+		size:  size,
+		codec: codec,
+	}
+}
+
+func (c *codecReader) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.r == nil || off < c.pos {
+		err := c.reset()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if off > c.pos {
+		n, err := io.CopyN(io.Discard, c.r, off-c.pos)
+		c.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(c.r, p)
+	c.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *codecReader) reset() error {
+	if c.r != nil {
+		c.r.Close()
+		c.r = nil
+	}
+	// codecs return typed nil readers on error, which must not be kept
+	r, err := c.codec.NewReader(io.NewSectionReader(c.src, 0, c.size))
+	if err != nil {
+		return err
+	}
+	c.r = r
+	c.pos = 0
+	return nil
+}
+
+func (c *codecReader) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.r != nil {
+		c.r.Close()
+		c.r = nil
+	}
+	return c.src.Close()
+}
+
+func min[T int | int64](a, b T) T {
+	if a < b {
+		return a
+	}
+	return b
+}
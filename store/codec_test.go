@@ -0,0 +1,232 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_Codec(t *testing.T) {
+	root := t.TempDir()
+	open := func(c Codec, chunking *ChunkingConfig) *BlobStore {
+		s, err := NewBlobStore(BlobStoreConfig{
+			Root:     root,
+			Logger:   zap.Must(zap.NewDevelopment()),
+			Codec:    c,
+			Chunking: chunking,
+		})
+		require.NoError(t, err)
+		return s
+	}
+
+	text := bytes.Repeat([]byte("compress me please. "), 10000)
+	random := randBytes(3, 64*1024)
+	chunkedText := bytes.Repeat([]byte("chunk and compress me. "), 20000)
+
+	s := open(GzipCodec{Level: 5}, nil)
+	putBlob(t, s, "text", text)
+	putBlob(t, s, "random", random)
+
+	e, _ := s.blobMap.Get("text")
+	assert.Equal(t, "gzip", e.Codec)
+	info, err := s.Stat(e.Path)
+	require.NoError(t, err)
+	assert.Equal(t, e.StoredSize, info.Size())
+	assert.Less(t, info.Size(), int64(len(text))/10)
+
+	e, _ = s.blobMap.Get("random")
+	assert.Equal(t, "", e.Codec)
+	require.NoError(t, s.Close())
+
+	s = open(FlateCodec{Level: 1}, &ChunkingConfig{MinSize: 1024, AvgSize: 4096, MaxSize: 16384})
+	putBlob(t, s, "chunked", chunkedText)
+	e, _ = s.blobMap.Get("chunked")
+	assert.True(t, e.Chunked)
+	m, err := s.readManifest(e.Path)
+	require.NoError(t, err)
+	for _, c := range m.Chunks {
+		assert.Equal(t, "flate", c.Codec)
+	}
+	// identical content keeps the encoding it was first stored with
+	putBlob(t, s, "text copy", text)
+	e, _ = s.blobMap.Get("text copy")
+	assert.Equal(t, "gzip", e.Codec)
+	require.NoError(t, s.Close())
+
+	// a store without a codec reads everything
+	s = open(nil, nil)
+	defer s.Close()
+	for key, want := range map[string][]byte{
+		"text":      text,
+		"text copy": text,
+		"random":    random,
+		"chunked":   chunkedText,
+	} {
+		got, err := s.ReadFile(key)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, key)
+	}
+	assert.Greater(t, s.Stats().SavedBytes(), int64(len(text)+len(chunkedText)))
+
+	// random access into compressed content, backwards as well
+	f, err := s.Open("text")
+	require.NoError(t, err)
+	defer f.Close()
+	buf := make([]byte, 10)
+	for _, off := range []int64{1000, 20, 150000} {
+		_, err := f.(io.ReaderAt).ReadAt(buf, off)
+		assert.NoError(t, err)
+		assert.Equal(t, text[off:off+10], buf)
+	}
+	info, err = f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(text)), info.Size())
+}
+
+// blockingCodec is gzip that blocks encoding until release is closed
+type blockingCodec struct {
+	GzipCodec
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c blockingCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	c.started <- struct{}{}
+	<-c.release
+	return c.GzipCodec.NewWriter(w)
+}
+
+func TestBlobStore_CodecUnlocked(t *testing.T) {
+	config := BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.NewNop(),
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+	text := bytes.Repeat([]byte("compress me please. "), 1000)
+	putBlob(t, s, "other", text)
+	require.NoError(t, s.Close())
+
+	c := blockingCodec{GzipCodec{Level: 5}, make(chan struct{}, 1), make(chan struct{})}
+	config.Codec = c
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		putBlob(t, s, "text", text[1:])
+	}()
+	<-c.started
+	// the encode doesn't hold up the rest of the store
+	removed := make(chan error, 1)
+	go func() { removed <- s.Remove("other") }()
+	select {
+	case err = <-removed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("remove blocked by the encode of another commit")
+	}
+	close(c.release)
+	<-done
+	got, err := s.ReadFile("text")
+	require.NoError(t, err)
+	assert.Equal(t, text[1:], got)
+}
+
+func TestBlobStore_CodecCorrupt(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.NewNop(),
+		Codec:  GzipCodec{Level: 5},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	putBlob(t, s, "text", bytes.Repeat([]byte("compress me please. "), 1000))
+	e, _ := s.blobMap.Get("text")
+	require.Equal(t, "gzip", e.Codec)
+	data, err := os.ReadFile(s.fullPath(e.Path))
+	require.NoError(t, err)
+	data[0] ^= 0xff
+	require.NoError(t, os.WriteFile(s.fullPath(e.Path), data, 0644))
+
+	// a bad gzip header fails reads, not Close
+	f, err := s.Open("text")
+	require.NoError(t, err)
+	_, err = io.ReadAll(f.(io.Reader))
+	assert.Error(t, err)
+	assert.NotPanics(t, func() { assert.NoError(t, f.Close()) })
+	_, err = s.ReadFile("text")
+	assert.Error(t, err)
+
+	var report ScrubReport
+	assert.NotPanics(t, func() {
+		report, err = s.Scrub(context.Background(), ScrubberConfig{})
+	})
+	require.NoError(t, err)
+	require.Len(t, report.Corrupt, 1)
+	assert.Equal(t, e.Path, report.Corrupt[0].Path)
+}
+
+func TestBlobStore_OrphanContent(t *testing.T) {
+	root := t.TempDir()
+	open := func(c Codec, chunking *ChunkingConfig) *BlobStore {
+		s, err := NewBlobStore(BlobStoreConfig{
+			Root:     root,
+			Logger:   zap.NewNop(),
+			Codec:    c,
+			Chunking: chunking,
+		})
+		require.NoError(t, err)
+		return s
+	}
+	// orphan leaves the stored file of key behind after removing it, like a
+	// crash part way through the release
+	orphan := func(s *BlobStore, key string) {
+		e, _ := s.blobMap.Get(key)
+		p := s.fullPath(e.Path)
+		data, err := os.ReadFile(p)
+		require.NoError(t, err)
+		require.NoError(t, s.Remove(key))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, data, 0644))
+		require.NoError(t, s.Close())
+	}
+
+	// stored plain, then written again with a codec
+	text := bytes.Repeat([]byte("compress me please. "), 1000)
+	s := open(nil, nil)
+	putBlob(t, s, "text", text)
+	orphan(s, "text")
+	s = open(GzipCodec{Level: 5}, nil)
+	putBlob(t, s, "text", text)
+	f, err := s.Open("text")
+	require.NoError(t, err)
+	got, err := io.ReadAll(f.(io.Reader))
+	require.NoError(t, err)
+	assert.Equal(t, text, got)
+	require.NoError(t, f.Close())
+	require.NoError(t, s.Close())
+
+	// stored chunked, then written again without chunking
+	big := randBytes(7, 1024*1024)
+	s = open(nil, &ChunkingConfig{MinSize: 16 * 1024, AvgSize: 64 * 1024, MaxSize: 256 * 1024})
+	putBlob(t, s, "big", big)
+	orphan(s, "big")
+	s = open(nil, nil)
+	defer s.Close()
+	putBlob(t, s, "big", big)
+	got, err = s.ReadFile("big")
+	require.NoError(t, err)
+	assert.Equal(t, big, got)
+}
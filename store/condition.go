@@ -0,0 +1,100 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPreconditionFailed is matched by a *PreconditionError
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// PreconditionError is returned when a conditional write finds the key in
+// a different state than required. the write is discarded
+type PreconditionError struct {
+	Key string
+	// Condition that failed: if-absent, if-digest or if-version
+	Condition string
+	// Exists, Digest and Version describe the key when the write was committed
+	Exists  bool
+	Digest  Digest
+	Version int64
+}
+
+func (e *PreconditionError) Error() string {
+	if !e.Exists {
+		return fmt.Sprintf("%s: %s: key '%s' does not exist", ErrPreconditionFailed, e.Condition, e.Key)
+	}
+	return fmt.Sprintf("%s: %s: key '%s' is at version %d with digest %s",
+		ErrPreconditionFailed, e.Condition, e.Key, e.Version, e.Digest)
+}
+
+func (e *PreconditionError) Unwrap() error {
+	return ErrPreconditionFailed
+}
+
+// condition must hold for a write to be committed
+type condition struct {
+	ifAbsent  bool
+	ifDigest  *Digest
+	ifVersion *int64
+}
+
+// IfAbsent only creates the key if it doesn't exist
+func IfAbsent() CreateOpt {
+	return func(c *CreateConfig) {
+		c.cond.ifAbsent = true
+	}
+}
+
+// IfDigest only replaces the key if its content has digest d
+func IfDigest(d Digest) CreateOpt {
+	return func(c *CreateConfig) {
+		c.cond.ifDigest = &d
+	}
+}
+
+// IfVersion only replaces the key if it is at version n
+func IfVersion(n int64) CreateOpt {
+	return func(c *CreateConfig) {
+		c.cond.ifVersion = &n
+	}
+}
+
+// check the condition against the state of key
+func (c condition) check(key string, exists bool, digest Digest, version int64) error {
+	fail := func(cond string) error {
+		return &PreconditionError{
+			Key:       key,
+			Condition: cond,
+			Exists:    exists,
+			Digest:    digest,
+			Version:   version,
+		}
+	}
+	if c.ifAbsent && exists {
+		return fail("if-absent")
+	}
+	if c.ifDigest != nil && (!exists || !c.ifDigest.Equal(digest)) {
+		return fail("if-digest")
+	}
+	if c.ifVersion != nil && (!exists || *c.ifVersion != version) {
+		return fail("if-version")
+	}
+	return nil
+}
+
+// checkCondition checks the condition of b against the current entry of
+// its key. s.mu must be held
+func (s *BlobStore) checkCondition(b *Blob) error {
+	key := b.Name()
+	e, exists := s.blobMap.Get(key)
+	if !exists || e.expired(time.Now()) {
+		return b.cond.check(key, false, Digest{}, 0)
+	}
+	d, err := e.digest()
+	if err != nil {
+		return err
+	}
+	return b.cond.check(key, true, d, e.Version)
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_ConditionalPut(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	put := func(key string, data string, opts ...CreateOpt) error {
+		w, err := s.CreateWith(key, opts...)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(data))
+		require.NoError(t, err)
+		return w.Close()
+	}
+	stat := func(key string) *BlobSys {
+		info, err := s.StatKey(key)
+		require.NoError(t, err)
+		return info.Sys().(*BlobSys)
+	}
+
+	// both writers started while the key was absent, only the first to commit wins
+	w1, err := s.CreateWith("k", IfAbsent())
+	require.NoError(t, err)
+	w2, err := s.CreateWith("k", IfAbsent())
+	require.NoError(t, err)
+	_, err = w1.Write([]byte("first"))
+	require.NoError(t, err)
+	_, err = w2.Write([]byte("second"))
+	require.NoError(t, err)
+	require.NoError(t, w1.Close())
+	err = w2.Close()
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+	var perr *PreconditionError
+	require.True(t, errors.As(err, &perr))
+	assert.Equal(t, "if-absent", perr.Condition)
+	assert.True(t, perr.Exists)
+	assert.Equal(t, int64(0), perr.Version)
+	got, err := s.ReadFile("k")
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(got))
+	staging, err := os.ReadDir(s.journal.stagingDir())
+	require.NoError(t, err)
+	assert.Len(t, staging, 0)
+	assert.Equal(t, int64(0), s.Usage().Pending)
+
+	v0 := stat("k")
+	assert.Equal(t, int64(0), v0.Version)
+	require.NoError(t, put("k", "second", IfDigest(v0.Digest)))
+	assert.Equal(t, int64(1), stat("k").Version)
+	assert.ErrorIs(t, put("k", "third", IfDigest(v0.Digest)), ErrPreconditionFailed)
+	assert.ErrorIs(t, put("k", "third", IfVersion(0)), ErrPreconditionFailed)
+	require.NoError(t, put("k", "third", IfVersion(1)))
+	assert.Equal(t, int64(2), stat("k").Version)
+	got, err = s.ReadFile("k")
+	require.NoError(t, err)
+	assert.Equal(t, "third", string(got))
+
+	err = put("missing", "x", IfVersion(0))
+	require.True(t, errors.As(err, &perr))
+	assert.False(t, perr.Exists)
+	_, err = s.Open("missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// a failed condition aborts the whole batch
+	b := s.NewBatch()
+	writeBatch(t, b, "other", []byte("other"))
+	w, err := b.Create("k", IfVersion(1))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.ErrorIs(t, b.Commit(), ErrPreconditionFailed)
+	_, err = s.Open("other")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Equal(t, int64(2), stat("k").Version)
+}
+
+func TestMemMeta_ConditionalRegister(t *testing.T) {
+	m := NewMemMeta(nil)
+	require.NoError(t, m.Register(&ObjectRef{Key: "k", Path: "p0"}, IfAbsent()))
+	assert.ErrorIs(t, m.Register(&ObjectRef{Key: "k", Path: "p1"}, IfAbsent()), ErrPreconditionFailed)
+	assert.ErrorIs(t, m.Register(&ObjectRef{Key: "k", Path: "p1"}, IfVersion(1)), ErrPreconditionFailed)
+	require.NoError(t, m.Register(&ObjectRef{Key: "k", Path: "p1"}, IfVersion(0)))
+	v, err := m.GetLatest("k")
+	require.NoError(t, err)
+	assert.Equal(t, 1, v.Version)
+	assert.Equal(t, "p1", v.Path)
+
+	// a digest can't be compared against a path that isn't a content path
+	err = m.Register(&ObjectRef{Key: "k", Path: "p2"}, IfDigest(DigestOf(hashOf(t, "p1"))))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrPreconditionFailed)
+}
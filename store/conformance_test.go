@@ -0,0 +1,274 @@
+package store
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testReadWriteStatFS checks the behavior every ReadWriteStatFS implementation shares
+func testReadWriteStatFS(t *testing.T, newFS func(t *testing.T) ReadWriteStatFS) {
+	put := func(t *testing.T, fsys ReadWriteStatFS, key string, data ...string) fs.FileInfo {
+		t.Helper()
+		w, err := fsys.Create(key)
+		require.NoError(t, err)
+		for _, d := range data {
+			_, err = w.Write([]byte(d))
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+		info, err := w.Stat()
+		require.NoError(t, err)
+		return info
+	}
+
+	t.Run("write and read", func(t *testing.T) {
+		fsys := newFS(t)
+		info := put(t, fsys, "dir/key", "some ", "content")
+		got, err := fsys.ReadFile("dir/key")
+		require.NoError(t, err)
+		assert.Equal(t, "some content", string(got))
+
+		sys, ok := info.Sys().(*BlobSys)
+		require.True(t, ok)
+		assert.Equal(t, "dir/key", sys.Key)
+		h, err := SHA256.New()
+		require.NoError(t, err)
+		h.Write([]byte("some content"))
+		assert.Equal(t, DigestOf(h), sys.Digest)
+		assert.Equal(t, ContentPath(h), info.Name())
+		assert.Equal(t, int64(len("some content")), info.Size())
+
+		pinfo, err := fsys.Stat(info.Name())
+		require.NoError(t, err)
+		assert.False(t, pinfo.IsDir())
+		assert.Equal(t, int64(len("some content")), pinfo.Size())
+
+		f, err := fsys.Open("dir/key")
+		require.NoError(t, err)
+		finfo, err := f.Stat()
+		require.NoError(t, err)
+		assert.Equal(t, "dir/key", finfo.Sys().(*BlobSys).Key)
+		assert.Equal(t, sys.Digest, finfo.Sys().(*BlobSys).Digest)
+		ra, ok := f.(io.ReaderAt)
+		require.True(t, ok)
+		buf := make([]byte, 7)
+		_, err = ra.ReadAt(buf, 5)
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(buf))
+		sk, ok := f.(io.Seeker)
+		require.True(t, ok)
+		_, err = sk.Seek(5, io.SeekStart)
+		require.NoError(t, err)
+		rest, err := io.ReadAll(f)
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(rest))
+		require.NoError(t, f.Close())
+		assert.ErrorIs(t, f.Close(), fs.ErrClosed)
+	})
+
+	t.Run("missing keys", func(t *testing.T) {
+		fsys := newFS(t)
+		_, err := fsys.Open("missing")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = fsys.ReadFile("missing")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.ErrorIs(t, fsys.Remove("missing"), fs.ErrNotExist)
+		_, err = fsys.Stat("no/such/path")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("close twice", func(t *testing.T) {
+		fsys := newFS(t)
+		w, err := fsys.Create("key")
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		assert.ErrorIs(t, w.Close(), fs.ErrClosed)
+		got, err := fsys.ReadFile("key")
+		require.NoError(t, err)
+		assert.Empty(t, got)
+	})
+
+	t.Run("dedup and remove", func(t *testing.T) {
+		fsys := newFS(t)
+		a := put(t, fsys, "a", "same")
+		b := put(t, fsys, "b", "same")
+		assert.Equal(t, a.Name(), b.Name())
+
+		require.NoError(t, fsys.Remove("a"))
+		_, err := fsys.Open("a")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		got, err := fsys.ReadFile("b")
+		require.NoError(t, err)
+		assert.Equal(t, "same", string(got))
+		_, err = fsys.Stat(a.Name())
+		assert.NoError(t, err)
+
+		require.NoError(t, fsys.Remove("b"))
+		_, err = fsys.Stat(a.Name())
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		fsys := newFS(t)
+		old := put(t, fsys, "key", "old")
+		put(t, fsys, "key", "new")
+		got, err := fsys.ReadFile("key")
+		require.NoError(t, err)
+		assert.Equal(t, "new", string(got))
+		_, err = fsys.Stat(old.Name())
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("walk content paths", func(t *testing.T) {
+		fsys := newFS(t)
+		want := make([]string, 0)
+		for i := 0; i < 5; i++ {
+			info := put(t, fsys, fmt.Sprintf("key%d", i), fmt.Sprintf("content %d", i))
+			want = append(want, info.Name())
+		}
+		sort.Strings(want)
+		got := make([]string, 0)
+		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path == storeDir {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			got = append(got, path)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+
+		root, err := fsys.Stat(".")
+		require.NoError(t, err)
+		assert.True(t, root.IsDir())
+	})
+
+	t.Run("concurrent writes", func(t *testing.T) {
+		fsys := newFS(t)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				w, err := fsys.Create(fmt.Sprintf("key%d", i))
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = w.Write([]byte(fmt.Sprintf("content %d", i%3)))
+				assert.NoError(t, err)
+				assert.NoError(t, w.Close())
+			}(i)
+		}
+		wg.Wait()
+		for i := 0; i < 10; i++ {
+			got, err := fsys.ReadFile(fmt.Sprintf("key%d", i))
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("content %d", i%3), string(got))
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		fsys := newFS(t)
+		put(t, fsys, "key", "committed")
+		w, err := fsys.Create("key")
+		require.NoError(t, err)
+		_, err = w.Write([]byte("partial"))
+		require.NoError(t, err)
+		a, ok := w.(Aborter)
+		require.True(t, ok)
+		require.NoError(t, a.Abort())
+		assert.ErrorIs(t, w.Close(), fs.ErrClosed)
+		got, err := fsys.ReadFile("key")
+		require.NoError(t, err)
+		assert.Equal(t, "committed", string(got))
+		if u, ok := fsys.(interface{ Usage() Usage }); ok {
+			assert.Equal(t, int64(0), u.Usage().Pending)
+		}
+	})
+
+	t.Run("copy and rename", func(t *testing.T) {
+		fsys := newFS(t)
+		c, ok := fsys.(Copier)
+		require.True(t, ok)
+		info := put(t, fsys, "src", "content")
+		put(t, fsys, "dst", "old")
+
+		require.NoError(t, c.Copy("src", "dst"))
+		got, err := fsys.ReadFile("dst")
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(got))
+		f, err := fsys.Open("dst")
+		require.NoError(t, err)
+		finfo, err := f.Stat()
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		assert.Equal(t, info.Sys().(*BlobSys).Digest, finfo.Sys().(*BlobSys).Digest)
+		assert.Equal(t, int64(1), finfo.Sys().(*BlobSys).Version)
+		// the replaced content is gone, the shared content isn't
+		_, err = fsys.Stat(ContentPath(hashOf(t, "old")))
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		_, err = fsys.Stat(info.Name())
+		require.NoError(t, err)
+
+		require.NoError(t, c.Rename("src", "moved"))
+		_, err = fsys.Open("src")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		got, err = fsys.ReadFile("moved")
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(got))
+
+		require.NoError(t, fsys.Remove("moved"))
+		got, err = fsys.ReadFile("dst")
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(got))
+		require.NoError(t, fsys.Remove("dst"))
+		_, err = fsys.Stat(info.Name())
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+
+		assert.ErrorIs(t, c.Copy("missing", "x"), fs.ErrNotExist)
+		assert.ErrorIs(t, c.Rename("missing", "x"), fs.ErrNotExist)
+	})
+}
+
+func hashOf(t *testing.T, data string) hash.Hash {
+	t.Helper()
+	h, err := SHA256.New()
+	require.NoError(t, err)
+	h.Write([]byte(data))
+	return h
+}
+
+func TestBlobStore_Conformance(t *testing.T) {
+	testReadWriteStatFS(t, func(t *testing.T) ReadWriteStatFS {
+		s, err := NewBlobStore(BlobStoreConfig{
+			Root:   t.TempDir(),
+			Logger: zap.NewNop(),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestMemStore_Conformance(t *testing.T) {
+	testReadWriteStatFS(t, func(t *testing.T) ReadWriteStatFS {
+		s, err := NewMemStore(MemStoreConfig{})
+		require.NoError(t, err)
+		return s
+	})
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Copier copies and renames keys without rewriting their content
+type Copier interface {
+	// Copy points dst at the content of src, overwriting dst if it exists
+	Copy(src string, dst string) error
+	// Rename moves src to dst, overwriting dst if it exists. readers see
+	// either src or dst, never both or neither
+	Rename(src string, dst string) error
+}
+
+var _ Copier = (*BlobStore)(nil)
+
+// Copy points dst at the content of src. only the index is updated, the
+// content is shared like that of keys written with identical data. dst
+// gets the metadata of src and is versioned like an overwrite
+func (s *BlobStore) Copy(src string, dst string) error {
+	return s.copyKey(src, dst, false)
+}
+
+// Rename moves src to dst. only the index is updated, and both keys
+// change at once. dst keeps the metadata and mod time of src
+func (s *BlobStore) Rename(src string, dst string) error {
+	return s.copyKey(src, dst, true)
+}
+
+func (s *BlobStore) copyKey(src string, dst string, move bool) error {
+	if move {
+		s.config.Logger.Sugar().Infof("renaming key %s to %s", src, dst)
+	} else {
+		s.config.Logger.Sugar().Infof("copying key %s to %s", src, dst)
+	}
+	s.mu.Lock()
+	e, ok := s.blobMap.Get(src)
+	if !ok || e.expired(time.Now()) {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", os.ErrNotExist, src)
+	}
+	if src == dst {
+		s.mu.Unlock()
+		return nil
+	}
+	err := s.copyEntry(e, dst, move)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.syncIndex()
+}
+
+// copyEntry registers the content of e under dst, and removes e if move.
+// s.mu must be held
+func (s *BlobStore) copyEntry(e *indexEntry, dst string, move bool) error {
+	credit := int64(0)
+	if prev, ok := s.blobMap.Get(dst); ok {
+		credit = prev.Size
+	}
+	from := ""
+	if move {
+		from = e.Key
+	}
+	err := s.usage.check(dst, from, e.Size, credit)
+	if err != nil {
+		return err
+	}
+	next := *e
+	next.Key = dst
+	next.Version = 0
+	next.ObjectMeta = e.ObjectMeta.clone()
+	if !move {
+		next.ModTime = time.Now()
+		return s.register(&next)
+	}
+	return s.update([]*indexEntry{&next}, []string{e.Key})
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_CopyRename(t *testing.T) {
+	root := t.TempDir()
+	config := BlobStoreConfig{
+		Root:     root,
+		Logger:   zap.NewNop(),
+		Chunking: &ChunkingConfig{MinSize: 1024, AvgSize: 4096, MaxSize: 16384},
+		Quotas:   map[string]int64{"small/": 100 * 1024},
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+
+	big := randBytes(7, 64*1024)
+	putBlob(t, s, "a", big)
+	require.NoError(t, s.SetMeta("a", ObjectMeta{ContentType: "application/octet-stream"}))
+	e, _ := s.blobMap.Get("a")
+	require.True(t, e.Chunked)
+	require.NoError(t, s.Copy("a", "b"))
+	assert.Equal(t, 2, s.blobMap.Refs(e.Path))
+	assert.Equal(t, int64(2*len(big)), s.Usage().Bytes)
+	info, err := s.StatKey("b")
+	require.NoError(t, err)
+	assert.Equal(t, "application/octet-stream", info.Sys().(*BlobSys).Meta.ContentType)
+
+	// removing the source keeps the shared chunks
+	require.NoError(t, s.Remove("a"))
+	got, err := s.ReadFile("b")
+	require.NoError(t, err)
+	assert.Equal(t, big, got)
+
+	// quotas apply to the destination, moves within a prefix are free
+	require.NoError(t, s.Rename("b", "small/b"))
+	assert.ErrorIs(t, s.Copy("small/b", "small/c"), ErrQuotaExceeded)
+	require.NoError(t, s.Rename("small/b", "small/c"))
+	assert.Equal(t, int64(len(big)), s.Usage().Quotas["small/"].Bytes)
+
+	// readers see the key under either name while it is renamed back and forth
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			keys, _, err := s.List("", "", 0)
+			if assert.NoError(t, err) && assert.Len(t, keys, 1) {
+				assert.Contains(t, []string{"small/c", "d"}, keys[0].Key)
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, s.Rename("small/c", "d"))
+		require.NoError(t, s.Rename("d", "small/c"))
+	}
+	close(stop)
+	wg.Wait()
+
+	// the index survives a restart, and the content goes with the last key
+	require.NoError(t, s.Close())
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	keys, _, err := s.List("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "small/c", keys[0].Key)
+	require.NoError(t, s.Remove("small/c"))
+	_, err = os.Stat(s.fullPath(e.Path))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Empty(t, s.chunks)
+}
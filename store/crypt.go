@@ -0,0 +1,424 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeyProvider supplies the keys content is encrypted with. keys are 32
+// bytes (AES-256) and identified by an id that is recorded with the
+// content, so rotating the current key leaves old content readable as
+// long as the provider still knows the old key
+type KeyProvider interface {
+	// CurrentKey is the key new content is encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id
+	Key(id string) ([]byte, error)
+}
+
+var ErrUnknownKey = errors.New("unknown key")
+
+// FileKeyProvider keeps keys in a json file
+//
+//	{"current": "<id>", "keys": {"<id>": "<hex key>", ...}}
+type FileKeyProvider struct {
+	path string
+
+	mu   sync.RWMutex
+	file keyFile
+}
+
+var _ KeyProvider = (*FileKeyProvider)(nil)
+
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// NewFileKeyProvider loads the keys at path. if the file doesn't exist it
+// is created with a new current key
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		p.file.Keys = make(map[string]string)
+		_, err = p.Rotate()
+		return p, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &p.file)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	if _, ok := p.file.Keys[p.file.Current]; !ok {
+		return nil, fmt.Errorf("key file %s: current key '%s' %w", path, p.file.Current, ErrUnknownKey)
+	}
+	return p, nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	p.mu.RLock()
+	id := p.file.Current
+	p.mu.RUnlock()
+	key, err := p.Key(id)
+	return id, key, err
+}
+
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	k, ok := p.file.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	return hex.DecodeString(k)
+}
+
+// Rotate generates a new current key. previous keys are kept for decryption
+func (p *FileKeyProvider) Rotate() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("%d-%s", time.Now().Unix(), hex.EncodeToString(suffix))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := keyFile{
+		Current: id,
+		Keys:    make(map[string]string, len(p.file.Keys)+1),
+	}
+	for k, v := range p.file.Keys {
+		next.Keys[k] = v
+	}
+	next.Keys[id] = hex.EncodeToString(key)
+	data, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(p.path), 0700)
+	if err != nil {
+		return "", err
+	}
+	err = writeFileAtomic(p.path, data, DurabilityDir)
+	if err != nil {
+		return "", err
+	}
+	err = os.Chmod(p.path, 0600)
+	if err != nil {
+		return "", err
+	}
+	p.file = next
+	return id, nil
+}
+
+// encrypted content is a header followed by AES-GCM sealed segments of
+// encSegmentSize plaintext bytes, so it can be decrypted at any offset.
+// every object is sealed with its own key, derived with HKDF from the
+// provider's key and a random salt from the header, so nonces only need
+// to be unique per object: the nonce of a segment is the segment number
+// and a flag marking the last segment, which makes reordering and
+// truncation detectable. the header is authenticated with every segment
+//
+//	magic | len(key id) | key id | segment size | salt
+//
+// segment sizes up to encMaxSegmentSize are read, so a corrupt header
+// can't force huge allocations
+const (
+	encMagic           = "FSE2"
+	encSegmentSize     = 64 * 1024
+	encMaxSegmentSize  = 16 * 1024 * 1024
+	encSaltSize        = 32
+	encNoncePrefixSize = 7
+	encKeyInfo         = "foreverstore content key"
+)
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// objectKey derives the key an object with salt is sealed with
+func objectKey(key []byte, salt []byte) ([]byte, error) {
+	sub := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(encKeyInfo)), sub)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func segmentNonce(prefix []byte, i int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encNoncePrefixSize:], uint32(i))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encrypt seals everything read from r with the current key of kp and writes it to w
+func encrypt(kp KeyProvider, w io.Writer, r io.Reader) (string, error) {
+	id, key, err := kp.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	return id, encryptWithKey(id, key, w, r)
+}
+
+func encryptWithKey(id string, key []byte, w io.Writer, r io.Reader) error {
+	if len(id) > 255 {
+		return fmt.Errorf("key id too long: %s", id)
+	}
+	salt := make([]byte, encSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	sub, err := objectKey(key, salt)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(sub)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, encNoncePrefixSize)
+
+	hdr := new(bytes.Buffer)
+	hdr.WriteString(encMagic)
+	hdr.WriteByte(byte(len(id)))
+	hdr.WriteString(id)
+	binary.Write(hdr, binary.BigEndian, uint32(encSegmentSize))
+	hdr.Write(salt)
+	aad := hdr.Bytes()
+	_, err = w.Write(aad)
+	if err != nil {
+		return err
+	}
+
+	// read one segment ahead to know which one is last
+	cur := make([]byte, encSegmentSize)
+	next := make([]byte, encSegmentSize)
+	n, err := io.ReadFull(r, cur)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	sealed := make([]byte, 0, encSegmentSize+aead.Overhead())
+	for i := int64(0); ; i++ {
+		last := n < encSegmentSize
+		m := 0
+		if !last {
+			m, err = io.ReadFull(r, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			last = m == 0
+		}
+		if i > int64(^uint32(0)) {
+			return fmt.Errorf("content too large to encrypt")
+		}
+		sealed = aead.Seal(sealed[:0], segmentNonce(prefix, i, last), cur[:n], aad)
+		_, err = w.Write(sealed)
+		if err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		cur, next = next, cur
+		n = m
+	}
+}
+
+func encryptBytes(kp KeyProvider, data []byte) ([]byte, string, error) {
+	buf := new(bytes.Buffer)
+	id, err := encrypt(kp, buf, bytes.NewReader(data))
+	return buf.Bytes(), id, err
+}
+
+// encryptFile encrypts the file at src into a new file in dir
+func encryptFile(kp KeyProvider, src string, dir string, d Durability) (string, int64, string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(dir, "blob-*")
+	if err != nil {
+		return "", 0, "", err
+	}
+	id, err := encrypt(kp, out, in)
+	if err == nil && d.syncFiles() {
+		err = out.Sync()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = out.Stat()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 0, "", err
+	}
+	return out.Name(), info.Size(), id, nil
+}
+
+// decryptReader decrypts segments on demand. the last decrypted segment is cached
+type decryptReader struct {
+	f      readerAtCloser
+	aead   cipher.AEAD
+	prefix []byte
+	// aad is the header
+	aad     []byte
+	segSize int64
+	dataOff int64
+	// size is the plaintext size
+	size     int64
+	segments int64
+
+	mu     sync.Mutex
+	cached int64
+	buf    []byte
+}
+
+var _ io.ReaderAt = (*decryptReader)(nil)
+
+// newDecryptReader decrypts the size encrypted bytes of f
+func newDecryptReader(f readerAtCloser, size int64, kp KeyProvider) (*decryptReader, error) {
+	hdr := make([]byte, len(encMagic)+1)
+	_, err := f.ReadAt(hdr, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	if string(hdr[:len(encMagic)]) != encMagic {
+		return nil, fmt.Errorf("not encrypted content")
+	}
+	idLen := int(hdr[len(encMagic)])
+	rest := make([]byte, idLen+4+encSaltSize)
+	_, err = f.ReadAt(rest, int64(len(hdr)))
+	if err != nil {
+		return nil, fmt.Errorf("reading encryption header: %w", err)
+	}
+	segSize := int64(binary.BigEndian.Uint32(rest[idLen:]))
+	if segSize == 0 || segSize > encMaxSegmentSize {
+		return nil, fmt.Errorf("invalid encryption segment size %d", segSize)
+	}
+	id := string(rest[:idLen])
+	key, err := kp.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	d := &decryptReader{
+		f:       f,
+		prefix:  make([]byte, encNoncePrefixSize),
+		aad:     append(hdr, rest...),
+		segSize: segSize,
+		dataOff: int64(len(hdr) + len(rest)),
+		cached:  -1,
+	}
+	key, err = objectKey(key, rest[idLen+4:])
+	if err != nil {
+		return nil, err
+	}
+	d.aead, err = newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	aead := d.aead
+	sealedSize := d.segSize + int64(aead.Overhead())
+	n := size - d.dataOff
+	full, rem := n/sealedSize, n%sealedSize
+	d.segments = full
+	d.size = full * d.segSize
+	if rem > 0 {
+		if rem < int64(aead.Overhead()) {
+			return nil, fmt.Errorf("truncated encrypted content")
+		}
+		d.segments++
+		d.size += rem - int64(aead.Overhead())
+	}
+	if d.segments == 0 {
+		return nil, fmt.Errorf("truncated encrypted content")
+	}
+	if d.size == 0 {
+		// nothing would ever be read, so authenticate it here
+		_, err = d.segment(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *decryptReader) segment(i int64) ([]byte, error) {
+	if d.cached == i {
+		return d.buf, nil
+	}
+	sealedSize := d.segSize + int64(d.aead.Overhead())
+	sealed := make([]byte, sealedSize)
+	n, err := d.f.ReadAt(sealed, d.dataOff+i*sealedSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	plain, err := d.aead.Open(d.buf[:0], segmentNonce(d.prefix, i, i == d.segments-1), sealed[:n], d.aad)
+	if err != nil {
+		d.cached = -1
+		return nil, fmt.Errorf("decrypting segment %d: %w", i, err)
+	}
+	d.buf = plain
+	d.cached = i
+	return plain, nil
+}
+
+func (d *decryptReader) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	read := 0
+	for read < len(p) && off < d.size {
+		seg, err := d.segment(off / d.segSize)
+		if err != nil {
+			return read, err
+		}
+		n := copy(p[read:], seg[off%d.segSize:])
+		read += n
+		off += int64(n)
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.f.Close()
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	kp, err := NewFileKeyProvider(filepath.Join(t.TempDir(), "keys.json"))
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	decrypt := func(data []byte) ([]byte, error) {
+		p := filepath.Join(dir, "enc")
+		require.NoError(t, os.WriteFile(p, data, 0644))
+		f, err := os.Open(p)
+		require.NoError(t, err)
+		d, err := newDecryptReader(f, int64(len(data)), kp)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		defer d.Close()
+		return io.ReadAll(io.NewSectionReader(d, 0, d.size))
+	}
+
+	for _, n := range []int{0, 1, encSegmentSize - 1, encSegmentSize, encSegmentSize + 1, 3 * encSegmentSize} {
+		plain := randBytes(int64(n), n)
+		enc, id, err := encryptBytes(kp, plain)
+		require.NoError(t, err)
+		cur, _, err := kp.CurrentKey()
+		require.NoError(t, err)
+		assert.Equal(t, cur, id)
+
+		got, err := decrypt(enc)
+		require.NoError(t, err, n)
+		assert.Equal(t, plain, append([]byte{}, got...), n)
+
+		if n > encSegmentSize {
+			// dropping the last segment is detected
+			last := n%encSegmentSize + 16
+			if n%encSegmentSize == 0 {
+				last = encSegmentSize + 16
+			}
+			_, err = decrypt(enc[:len(enc)-last])
+			assert.Error(t, err, n)
+		}
+		if n > 0 {
+			tampered := append([]byte{}, enc...)
+			tampered[len(tampered)-1] ^= 1
+			_, err = decrypt(tampered)
+			assert.Error(t, err, n)
+		}
+		// the header is authenticated too
+		tampered := append([]byte{}, enc...)
+		tampered[len(encMagic)+1+len(id)+4] ^= 1
+		_, err = decrypt(tampered)
+		assert.Error(t, err, n)
+	}
+
+	// identical plaintext is sealed under different object keys
+	a, _, err := encryptBytes(kp, []byte("same"))
+	require.NoError(t, err)
+	b, _, err := encryptBytes(kp, []byte("same"))
+	require.NoError(t, err)
+	assert.NotEqual(t, a[len(a)-20:], b[len(b)-20:])
+
+	// segment sizes that are zero or too large are rejected
+	enc, _, err := encryptBytes(kp, []byte("content"))
+	require.NoError(t, err)
+	sizeOff := len(encMagic) + 1 + int(enc[len(encMagic)])
+	for _, size := range []uint32{0, encMaxSegmentSize + 1, 1<<32 - 1} {
+		bad := append([]byte{}, enc...)
+		binary.BigEndian.PutUint32(bad[sizeOff:], size)
+		_, err = decrypt(bad)
+		assert.ErrorContains(t, err, "segment size", size)
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "keys.json")
+	kp, err := NewFileKeyProvider(p)
+	require.NoError(t, err)
+	id1, k1, err := kp.CurrentKey()
+	require.NoError(t, err)
+	assert.Len(t, k1, 32)
+
+	id2, err := kp.Rotate()
+	require.NoError(t, err)
+	assert.NotEqual(t, id1, id2)
+
+	kp, err = NewFileKeyProvider(p)
+	require.NoError(t, err)
+	cur, _, err := kp.CurrentKey()
+	require.NoError(t, err)
+	assert.Equal(t, id2, cur)
+	got, err := kp.Key(id1)
+	require.NoError(t, err)
+	assert.Equal(t, k1, got)
+	_, err = kp.Key("missing")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	info, err := os.Stat(p)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestBlobStore_Encrypted(t *testing.T) {
+	root := t.TempDir()
+	kp, err := NewFileKeyProvider(filepath.Join(t.TempDir(), "keys.json"))
+	require.NoError(t, err)
+	open := func(kp KeyProvider) *BlobStore {
+		s, err := NewBlobStore(BlobStoreConfig{
+			Root:        root,
+			Logger:      zap.Must(zap.NewDevelopment()),
+			KeyProvider: kp,
+			Codec:       GzipCodec{Level: 5},
+			Chunking:    &ChunkingConfig{MinSize: 16 * 1024, AvgSize: 64 * 1024, MaxSize: 128 * 1024},
+		})
+		require.NoError(t, err)
+		return s
+	}
+
+	secret := bytes.Repeat([]byte("top secret "), 1000)
+	big := randBytes(4, 512*1024)
+
+	s := open(kp)
+	putBlob(t, s, "secret", secret)
+	putBlob(t, s, "big", big)
+	oldKey, _, err := kp.CurrentKey()
+	require.NoError(t, err)
+
+	e, _ := s.blobMap.Get("secret")
+	assert.Equal(t, oldKey, e.KeyID)
+	assert.Equal(t, "gzip", e.Codec)
+	raw, err := os.ReadFile(s.fullPath(e.Path))
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "top secret")
+
+	// rotate, new content uses the new key, old content stays readable
+	newKey, err := kp.Rotate()
+	require.NoError(t, err)
+	putBlob(t, s, "after rotation", []byte("written with the new key"))
+	e, _ = s.blobMap.Get("after rotation")
+	assert.Equal(t, newKey, e.KeyID)
+	require.NoError(t, s.Close())
+
+	s = open(kp)
+	for key, want := range map[string][]byte{
+		"secret":         secret,
+		"big":            big,
+		"after rotation": []byte("written with the new key"),
+	} {
+		got, err := s.ReadFile(key)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, key)
+	}
+	f, err := s.Open("big")
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	_, err = f.(io.ReaderAt).ReadAt(buf, 300000)
+	assert.NoError(t, err)
+	assert.Equal(t, big[300000:300100], buf)
+	assert.NoError(t, f.Close())
+	require.NoError(t, s.Close())
+
+	// without the keys nothing can be read
+	s = open(nil)
+	defer s.Close()
+	_, err = s.ReadFile("secret")
+	assert.Error(t, err)
+}
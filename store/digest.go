@@ -0,0 +1,177 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"path/filepath"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// HashAlgorithm identifies a digest algorithm by its multihash code
+// https://github.com/multiformats/multicodec/blob/master/table.csv
+type HashAlgorithm uint64
+
+const (
+	SHA256     HashAlgorithm = 0x12
+	SHA512     HashAlgorithm = 0x13
+	BLAKE2b256 HashAlgorithm = 0xb220
+	BLAKE2b512 HashAlgorithm = 0xb240
+
+	DefaultHashAlgorithm = SHA256
+)
+
+func (a HashAlgorithm) String() string {
+	switch a {
+	case SHA256:
+		return "sha2-256"
+	case SHA512:
+		return "sha2-512"
+	case BLAKE2b256:
+		return "blake2b-256"
+	case BLAKE2b512:
+		return "blake2b-512"
+	}
+	return fmt.Sprintf("unknown(0x%x)", uint64(a))
+}
+
+// Size is the length in bytes of digests produced by the algorithm
+func (a HashAlgorithm) Size() int {
+	switch a {
+	case SHA256, BLAKE2b256:
+		return 32
+	case SHA512, BLAKE2b512:
+		return 64
+	}
+	return 0
+}
+
+func (a HashAlgorithm) Valid() bool {
+	return a.Size() != 0
+}
+
+// New returns a hash for the algorithm that reports the algorithm it uses,
+// so that PathFuncs can produce self describing paths
+func (a HashAlgorithm) New() (hash.Hash, error) {
+	var h hash.Hash
+	var err error
+	switch a {
+	case SHA256:
+		h = sha256.New()
+	case SHA512:
+		h = sha512.New()
+	case BLAKE2b256:
+		h, err = blake2b.New256(nil)
+	case BLAKE2b512:
+		h, err = blake2b.New512(nil)
+	default:
+		err = fmt.Errorf("unsupported hash algorithm %s", a)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &algorithmHash{Hash: h, alg: a}, nil
+}
+
+type algorithmHash struct {
+	hash.Hash
+	alg HashAlgorithm
+}
+
+func (h *algorithmHash) Algorithm() HashAlgorithm {
+	return h.alg
+}
+
+// sumHash is a hash.Hash that sums to a fixed sum, to resolve the path of
+// content by its digest with a PathFunc. writes are ignored
+type sumHash struct {
+	sum []byte
+}
+
+func (h *sumHash) Write(p []byte) (int, error) { return len(p), nil }
+func (h *sumHash) Sum(b []byte) []byte         { return append(b, h.sum...) }
+func (h *sumHash) Reset()                      {}
+func (h *sumHash) Size() int                   { return len(h.sum) }
+func (h *sumHash) BlockSize() int              { return 1 }
+
+// Digest is a self describing hash sum
+type Digest struct {
+	Algorithm HashAlgorithm
+	Sum       []byte
+}
+
+// DigestOf returns the current digest of h. hashes that don't know their
+// algorithm are assumed to be sha256, which is all the store used to write
+func DigestOf(h hash.Hash) Digest {
+	alg := SHA256
+	if a, ok := h.(interface{ Algorithm() HashAlgorithm }); ok {
+		alg = a.Algorithm()
+	}
+	return Digest{Algorithm: alg, Sum: h.Sum(nil)}
+}
+
+// Bytes encodes the digest as a multihash: <varint code><varint length><sum>
+func (d Digest) Bytes() []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64+len(d.Sum))
+	n := binary.PutUvarint(buf, uint64(d.Algorithm))
+	n += binary.PutUvarint(buf[n:], uint64(len(d.Sum)))
+	n += copy(buf[n:], d.Sum)
+	return buf[:n]
+}
+
+// String is the hex encoded multihash
+func (d Digest) String() string {
+	return hex.EncodeToString(d.Bytes())
+}
+
+func (d Digest) Equal(o Digest) bool {
+	return d.Algorithm == o.Algorithm && bytes.Equal(d.Sum, o.Sum)
+}
+
+// ParseDigest decodes a hex encoded multihash. the algorithm must be known
+// and the length must match it
+func ParseDigest(s string) (Digest, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return Digest{}, err
+	}
+	code, n := binary.Uvarint(b)
+	if n <= 0 {
+		return Digest{}, fmt.Errorf("bad digest %s: invalid algorithm", s)
+	}
+	b = b[n:]
+	l, n := binary.Uvarint(b)
+	if n <= 0 {
+		return Digest{}, fmt.Errorf("bad digest %s: invalid length", s)
+	}
+	b = b[n:]
+	alg := HashAlgorithm(code)
+	if !alg.Valid() {
+		return Digest{}, fmt.Errorf("bad digest %s: unsupported algorithm %s", s, alg)
+	}
+	if int(l) != len(b) || len(b) != alg.Size() {
+		return Digest{}, fmt.Errorf("bad digest %s: length %d for %s", s, len(b), alg)
+	}
+	return Digest{Algorithm: alg, Sum: b}, nil
+}
+
+// digestFromPath recovers the digest from a content path. legacy paths are the
+// plain hex sha256 sum. a legacy name can't be mistaken for a multihash because
+// no supported algorithm has a 30 or 28 byte sum.
+func digestFromPath(p string) (Digest, error) {
+	name := filepath.Base(p)
+	d, err := ParseDigest(name)
+	if err == nil {
+		return d, nil
+	}
+	b, herr := hex.DecodeString(name)
+	if herr == nil && len(b) == SHA256.Size() {
+		return Digest{Algorithm: SHA256, Sum: b}, nil
+	}
+	return Digest{}, err
+}
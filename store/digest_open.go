@@ -0,0 +1,122 @@
+package store
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+)
+
+// contentPaths are the paths content with digest d may be stored at: the
+// path PathFunc gives it, and for sha256 also the path of content written
+// before digests were self describing
+func (s *BlobStore) contentPaths(d Digest) []string {
+	pth := s.config.PathFunc(&algorithmHash{Hash: &sumHash{sum: d.Sum}, alg: d.Algorithm})
+	out := []string{pth}
+	if d.Algorithm == SHA256 {
+		if legacy := s.config.PathFunc(&sumHash{sum: d.Sum}); legacy != pth {
+			out = append(out, legacy)
+		}
+	}
+	return out
+}
+
+// digestEntry describes the stored content with digest d, which is
+// either the content of a key or a chunk. s.mu must be held
+func (s *BlobStore) digestEntry(d Digest) (*indexEntry, bool) {
+	for _, pth := range s.contentPaths(d) {
+		if e, ok := s.blobMap.GetByPath(pth); ok {
+			if s.contentExists(pth, e.storage) {
+				return e, true
+			}
+			continue
+		}
+		if c, ok := s.chunks[pth]; ok && s.contentExists(pth, c.storage()) {
+			return &indexEntry{Path: pth, Size: c.Size, storage: c.storage()}, true
+		}
+	}
+	return nil, false
+}
+
+// HasDigest reports whether content with digest d is stored, as a key or
+// as a chunk of one
+func (s *BlobStore) HasDigest(d Digest) bool {
+	if !d.Algorithm.Valid() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.digestEntry(d)
+	return ok
+}
+
+// OpenDigest opens the content with digest d, without a key. the content
+// is verified as it is read: reaching the end of content that doesn't
+// hash to d fails with ErrDigestMismatch rather than io.EOF
+func (s *BlobStore) OpenDigest(d Digest) (fs.File, error) {
+	h, err := d.Algorithm.New()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	e, ok := s.digestEntry(d)
+	var b *Blob
+	if ok {
+		b, err = s.openEntry(e)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: digest %s", os.ErrNotExist, d)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.stored(d, e.ModTime)
+	return &verifiedFile{b: b, h: h, want: d}, nil
+}
+
+// DigestKeys returns the keys whose content has digest d, sorted
+func (s *BlobStore) DigestKeys(d Digest) []string {
+	now := time.Now()
+	out := make([]string, 0)
+	for _, pth := range s.contentPaths(d) {
+		for _, k := range s.blobMap.Keys(pth) {
+			if e, ok := s.blobMap.Get(k); ok && !e.expired(now) {
+				out = append(out, k)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// verifiedFile hashes the content of a blob as it is read, and checks it
+// against the expected digest at the end. it deliberately doesn't support
+// ReadAt and Seek, which would bypass the check
+type verifiedFile struct {
+	b    *Blob
+	h    hash.Hash
+	want Digest
+}
+
+func (f *verifiedFile) Read(p []byte) (int, error) {
+	n, err := f.b.Read(p)
+	f.h.Write(p[:n])
+	if err == io.EOF {
+		if got := DigestOf(f.h); !got.Equal(f.want) {
+			return n, fmt.Errorf("%w: %s hashes to %s", ErrDigestMismatch, f.want, got)
+		}
+	}
+	return n, err
+}
+
+func (f *verifiedFile) Stat() (fs.FileInfo, error) {
+	return f.b.Stat()
+}
+
+func (f *verifiedFile) Close() error {
+	return f.b.Close()
+}
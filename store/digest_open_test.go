@@ -0,0 +1,75 @@
+package store
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_OpenDigest(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:     t.TempDir(),
+		Logger:   zap.NewNop(),
+		Chunking: &ChunkingConfig{MinSize: 1024, AvgSize: 4096, MaxSize: 16384},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	putBlob(t, s, "a", []byte("some content"))
+	require.NoError(t, s.Copy("a", "b"))
+	info, err := s.StatKey("a")
+	require.NoError(t, err)
+	d := info.Sys().(*BlobSys).Digest
+
+	assert.True(t, s.HasDigest(d))
+	assert.Equal(t, []string{"a", "b"}, s.DigestKeys(d))
+	f, err := s.OpenDigest(d)
+	require.NoError(t, err)
+	got, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "some content", string(got))
+	finfo, err := f.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, d, finfo.Sys().(*BlobSys).Digest)
+	require.NoError(t, f.Close())
+
+	// chunks can be fetched by digest too, but no key references them
+	big := randBytes(9, 64*1024)
+	putBlob(t, s, "big", big)
+	e, _ := s.blobMap.Get("big")
+	require.True(t, e.Chunked)
+	m, err := s.readManifest(e.Path)
+	require.NoError(t, err)
+	chunk := m.Chunks[1]
+	cd, err := digestFromPath(chunk.Path)
+	require.NoError(t, err)
+	assert.True(t, s.HasDigest(cd))
+	assert.Empty(t, s.DigestKeys(cd))
+	f, err = s.OpenDigest(cd)
+	require.NoError(t, err)
+	got, err = io.ReadAll(f)
+	require.NoError(t, err)
+	f.Close()
+	assert.Equal(t, chunk.Size, int64(len(got)))
+	assert.Equal(t, big[m.Chunks[0].Size:m.Chunks[0].Size+chunk.Size], got)
+
+	// unknown content
+	h := hashOf(t, "not stored")
+	missing := DigestOf(h)
+	assert.False(t, s.HasDigest(missing))
+	assert.Empty(t, s.DigestKeys(missing))
+	_, err = s.OpenDigest(missing)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// corrupt content fails the read
+	require.NoError(t, os.WriteFile(s.fullPath(info.Name()), []byte("some c0ntent"), 0644))
+	f, err = s.OpenDigest(d)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = io.ReadAll(f)
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestDigest_RoundTrip(t *testing.T) {
+	for _, alg := range []HashAlgorithm{SHA256, SHA512, BLAKE2b256, BLAKE2b512} {
+		t.Run(alg.String(), func(t *testing.T) {
+			h, err := alg.New()
+			require.NoError(t, err)
+			h.Write([]byte("some content"))
+			d := DigestOf(h)
+			assert.Equal(t, alg, d.Algorithm)
+			assert.Len(t, d.Sum, alg.Size())
+
+			got, err := ParseDigest(d.String())
+			require.NoError(t, err)
+			assert.True(t, d.Equal(got))
+
+			got, err = digestFromPath(ContentPath(h))
+			require.NoError(t, err)
+			assert.True(t, d.Equal(got))
+		})
+	}
+
+	t.Run("legacy path", func(t *testing.T) {
+		h := sha256.New()
+		h.Write([]byte("some content"))
+		got, err := digestFromPath(ContentPath(h))
+		require.NoError(t, err)
+		assert.Equal(t, SHA256, got.Algorithm)
+		assert.Equal(t, h.Sum(nil), got.Sum)
+	})
+
+	t.Run("bad digests", func(t *testing.T) {
+		_, err := ParseDigest("zz")
+		assert.Error(t, err)
+		// sha256 code with a short sum
+		_, err = ParseDigest("1202abcd")
+		assert.Error(t, err)
+		// unknown code
+		_, err = ParseDigest("0102ab")
+		assert.Error(t, err)
+	})
+}
+
+func TestBlobStore_MixedAlgorithms(t *testing.T) {
+	root := t.TempDir()
+	open := func(alg HashAlgorithm) *BlobStore {
+		s, err := NewBlobStore(BlobStoreConfig{
+			Root:          root,
+			Logger:        zap.Must(zap.NewDevelopment()),
+			HashAlgorithm: alg,
+		})
+		require.NoError(t, err)
+		return s
+	}
+
+	s := open(SHA256)
+	putBlob(t, s, "sha", []byte("sha content"))
+	require.NoError(t, s.Close())
+
+	s = open(BLAKE2b256)
+	defer s.Close()
+	putBlob(t, s, "blake", []byte("blake content"))
+
+	for key, alg := range map[string]HashAlgorithm{"sha": SHA256, "blake": BLAKE2b256} {
+		e, ok := s.blobMap.Get(key)
+		require.True(t, ok)
+		d, err := digestFromPath(e.Path)
+		require.NoError(t, err)
+		assert.Equal(t, alg, d.Algorithm, key)
+		assert.True(t, strings.HasPrefix(filepath.Base(e.Path), Digest{Algorithm: alg}.String()[:2]))
+
+		got, err := s.ReadFile(key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(key+" content"), got)
+	}
+
+	_, err := NewBlobStore(BlobStoreConfig{Root: root, HashAlgorithm: HashAlgorithm(0x99)})
+	assert.Error(t, err)
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// Durability is how hard the store works to keep acknowledged writes
+// across a crash or power loss. a write is acknowledged when the blob's
+// Close returns, and removes and metadata updates when they return
+type Durability int
+
+const (
+	// DurabilityDefault is DefaultDurability
+	DurabilityDefault Durability = iota
+	// DurabilityNone never syncs. the store stays consistent if the
+	// process crashes, but recent writes can be lost or truncated if the
+	// machine does
+	DurabilityNone
+	// DurabilityFile syncs written data, journal intents and index
+	// updates, but not the directories they are created or renamed in
+	DurabilityFile
+	// DurabilityDir also syncs the parent directory after every create
+	// or rename, so the names of new files survive a power loss too
+	DurabilityDir
+	// DurabilityGroupCommit is as durable as DurabilityDir, but the index
+	// and content directory syncs of concurrent commits are shared: a
+	// commit waits for the next sync rather than making its own
+	DurabilityGroupCommit
+)
+
+// DefaultDurability is used when BlobStoreConfig.Durability is unset. it
+// is the cheapest setting that keeps a power loss from leaving a key
+// pointing at missing or partial content. in BenchmarkBlobStore_Durability
+// on ext4 it doubles the cost of a 4KiB write over DurabilityNone, and
+// group commit was within noise of it even with 8 writers: most of the
+// cost is journaling the intent, which can't be shared
+const DefaultDurability = DurabilityDir
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityDefault:
+		return "default"
+	case DurabilityNone:
+		return "none"
+	case DurabilityFile:
+		return "file"
+	case DurabilityDir:
+		return "dir"
+	case DurabilityGroupCommit:
+		return "group-commit"
+	}
+	return fmt.Sprintf("durability(%d)", int(d))
+}
+
+func (d Durability) Valid() bool {
+	return d >= DurabilityDefault && d <= DurabilityGroupCommit
+}
+
+// syncFiles reports whether file contents are synced
+func (d Durability) syncFiles() bool {
+	return d >= DurabilityFile
+}
+
+// syncDirs reports whether directories are synced after creates and renames
+func (d Durability) syncDirs() bool {
+	return d >= DurabilityDir
+}
+
+// end makes a commit durable as configured and ends its intent. s.mu
+// must be held, so that intents end in commit order: an intent that is
+// still pending when a later commit of the same key ends would be
+// replayed over it by recover. with group commit the intent is added to
+// the next group instead, which is returned to be waited for without s.mu
+func (s *BlobStore) end(in *writeIntent) (*commitGroup, error) {
+	switch s.config.Durability {
+	case DurabilityGroupCommit:
+		return s.group.add(in), nil
+	case DurabilityFile, DurabilityDir:
+		err := s.blobMap.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, s.journal.end(in)
+}
+
+// syncIndex makes index updates that aren't journaled durable, eg removes.
+// it is called without s.mu
+func (s *BlobStore) syncIndex() error {
+	switch s.config.Durability {
+	case DurabilityGroupCommit:
+		return s.group.wait(s.group.add(nil))
+	case DurabilityFile, DurabilityDir:
+		return s.blobMap.Sync()
+	}
+	return nil
+}
+
+// flushGroup syncs the dirs content was placed in and the index for a
+// group of commits, then ends their intents
+func (s *BlobStore) flushGroup(intents []*writeIntent) error {
+	dirs := make(map[string]bool)
+	for _, in := range intents {
+		if in == nil {
+			continue
+		}
+		items := in.Batch
+		if len(items) == 0 {
+			items = []*writeIntent{in}
+		}
+		for _, item := range items {
+			if item.placed {
+				dirs[filepath.Dir(s.fullPath(item.Path))] = true
+			}
+		}
+	}
+	for dir := range dirs {
+		err := syncDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.blobMap.Sync()
+	if err != nil {
+		return err
+	}
+	for _, in := range intents {
+		if in == nil {
+			continue
+		}
+		err = s.journal.end(in)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupCommit shares syncs between concurrent commits. the first commit
+// to arrive while no flush is running flushes, and keeps flushing the
+// commits that arrive meanwhile until there are none. a failed flush
+// fails all later commits, ending their intents could let recover replay
+// the intents of the failed group over them
+type groupCommit struct {
+	flush func([]*writeIntent) error
+
+	mu       sync.Mutex
+	next     *commitGroup
+	flushing bool
+	err      error
+}
+
+type commitGroup struct {
+	intents []*writeIntent
+	done    chan struct{}
+	err     error
+}
+
+// add adds in to the next group to flush. in may be nil to flush the
+// index only
+func (g *groupCommit) add(in *writeIntent) *commitGroup {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.next == nil {
+		g.next = &commitGroup{done: make(chan struct{})}
+	}
+	g.next.intents = append(g.next.intents, in)
+	return g.next
+}
+
+// wait waits until grp is flushed, flushing it if no flush is running
+func (g *groupCommit) wait(grp *commitGroup) error {
+	g.mu.Lock()
+	lead := !g.flushing
+	g.flushing = true
+	g.mu.Unlock()
+	if lead {
+		g.run()
+	}
+	<-grp.done
+	return grp.err
+}
+
+func (g *groupCommit) run() {
+	for {
+		g.mu.Lock()
+		grp := g.next
+		g.next = nil
+		if grp == nil {
+			g.flushing = false
+			g.mu.Unlock()
+			return
+		}
+		err := g.err
+		g.mu.Unlock()
+		if err == nil {
+			err = g.flush(grp.intents)
+			if err != nil {
+				err = fmt.Errorf("group commit failed: %w", err)
+				g.mu.Lock()
+				g.err = err
+				g.mu.Unlock()
+			}
+		}
+		grp.err = err
+		close(grp.done)
+	}
+}
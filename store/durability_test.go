@@ -0,0 +1,110 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_Durability(t *testing.T) {
+	_, err := NewBlobStore(BlobStoreConfig{Root: t.TempDir(), Durability: Durability(42)})
+	assert.Error(t, err)
+
+	for _, d := range []Durability{DurabilityDefault, DurabilityNone, DurabilityFile, DurabilityDir, DurabilityGroupCommit} {
+		t.Run(d.String(), func(t *testing.T) {
+			root := t.TempDir()
+			config := BlobStoreConfig{
+				Root:       root,
+				Logger:     zap.NewNop(),
+				Pack:       &PackConfig{},
+				Durability: d,
+			}
+			s, err := NewBlobStore(config)
+			require.NoError(t, err)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						putBlob(t, s, fmt.Sprintf("w%d/%d", i, j), randBytes(int64(i*10+j), 16*1024))
+					}
+				}(i)
+			}
+			wg.Wait()
+			batch := s.NewBatch()
+			b, err := batch.Create("batched")
+			require.NoError(t, err)
+			_, err = b.Write([]byte("small"))
+			require.NoError(t, err)
+			require.NoError(t, b.Close())
+			require.NoError(t, batch.Commit())
+			require.NoError(t, s.Remove("w0/0"))
+			require.NoError(t, s.SetMeta("w0/1", ObjectMeta{ContentType: "text/plain"}))
+
+			// every commit has ended once it returned
+			ents, err := os.ReadDir(s.journal.dir())
+			require.NoError(t, err)
+			assert.Empty(t, ents)
+			require.NoError(t, s.Close())
+
+			s, err = NewBlobStore(config)
+			require.NoError(t, err)
+			defer s.Close()
+			assert.Equal(t, 80, s.blobMap.Len())
+			got, err := s.ReadFile("w7/9")
+			require.NoError(t, err)
+			assert.Equal(t, randBytes(79, 16*1024), got)
+			got, err = s.ReadFile("batched")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("small"), got)
+		})
+	}
+}
+
+// BenchmarkBlobStore_Durability compares the cost of a 4KiB write under
+// each durability, by one writer and by many
+func BenchmarkBlobStore_Durability(b *testing.B) {
+	data := randBytes(1, 4096)
+	for _, d := range []Durability{DurabilityNone, DurabilityFile, DurabilityDir, DurabilityGroupCommit} {
+		for _, parallel := range []bool{false, true} {
+			name := d.String() + "/serial"
+			if parallel {
+				name = d.String() + "/parallel"
+			}
+			b.Run(name, func(b *testing.B) {
+				s, err := NewBlobStore(BlobStoreConfig{
+					Root:       b.TempDir(),
+					Logger:     zap.NewNop(),
+					Durability: d,
+				})
+				require.NoError(b, err)
+				defer s.Close()
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				if !parallel {
+					for i := 0; i < b.N; i++ {
+						// unique content, so that every write is stored
+						putBlob(b, s, fmt.Sprintf("k%d", i), append(data[:len(data):len(data)], byte(i), byte(i>>8), byte(i>>16)))
+					}
+					return
+				}
+				b.SetParallelism(8)
+				var n int64
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						i := atomic.AddInt64(&n, 1)
+						putBlob(b, s, fmt.Sprintf("k%d", i), append(data[:len(data):len(data)], byte(i), byte(i>>8), byte(i>>16)))
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// an export is a tar stream with an entry per key, named exportPrefix+key.
+// the digest, version and metadata of the key are pax records
+const (
+	exportPrefix     = "keys/"
+	paxDigestRecord  = "FOREVERSTORE.digest"
+	paxVersionRecord = "FOREVERSTORE.version"
+	paxMetaRecord    = "FOREVERSTORE.meta"
+)
+
+var ErrInvalidExport = errors.New("invalid export")
+
+// Export writes the keys with prefix to w as a tar stream. it is a point
+// in time snapshot: keys written or removed while it runs aren't included
+// or are still exported, and content isn't deleted until it is exported
+func (s *BlobStore) Export(w io.Writer, prefix string) error {
+	now := time.Now()
+	s.mu.Lock()
+	entries := make([]*indexEntry, 0)
+	for _, e := range s.blobMap.Values() {
+		if strings.HasPrefix(e.Key, prefix) && !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	paths := make([]string, len(entries))
+	for i, e := range entries {
+		paths[i] = e.Path
+	}
+	s.pin(paths)
+	s.mu.Unlock()
+
+	err := s.export(w, entries)
+	if uerr := s.unpin(paths); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+func (s *BlobStore) export(w io.Writer, entries []*indexEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		meta, err := json.Marshal(e.ObjectMeta)
+		if err != nil {
+			return err
+		}
+		// entries written before digests were recorded have it in their path
+		d, err := e.digest()
+		if err != nil {
+			return fmt.Errorf("key %s: %w", e.Key, err)
+		}
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     exportPrefix + e.Key,
+			Size:     e.Size,
+			Mode:     0644,
+			ModTime:  e.ModTime,
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				paxDigestRecord:  d.String(),
+				paxVersionRecord: strconv.FormatInt(e.Version, 10),
+				paxMetaRecord:    string(meta),
+			},
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		b, err := s.openEntry(e)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", e.Key, err)
+		}
+		_, err = io.Copy(tw, b)
+		b.Close()
+		if err != nil {
+			return fmt.Errorf("key %s: %w", e.Key, err)
+		}
+	}
+	s.config.Logger.Sugar().Infof("exported %d keys", len(entries))
+	return tw.Close()
+}
+
+// Import reads a stream written by Export into the store. every object is
+// verified against its digest, and the keys become visible at once when
+// the whole stream has been read. keys that are new keep their version,
+// existing keys are overwritten
+func (s *BlobStore) Import(r io.Reader) error {
+	batch := s.NewBatch()
+	err := s.importAll(tar.NewReader(r), batch)
+	if err != nil {
+		batch.Abort()
+		return err
+	}
+	return batch.Commit()
+}
+
+func (s *BlobStore) importAll(tr *tar.Reader, batch *Batch) error {
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(hdr.Name, exportPrefix) {
+			return fmt.Errorf("%w: unexpected entry %s", ErrInvalidExport, hdr.Name)
+		}
+		key := strings.TrimPrefix(hdr.Name, exportPrefix)
+		err = s.importEntry(tr, hdr, key, batch)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", key, err)
+		}
+		n++
+	}
+	s.config.Logger.Sugar().Infof("imported %d keys", n)
+	return nil
+}
+
+func (s *BlobStore) importEntry(r io.Reader, hdr *tar.Header, key string, batch *Batch) error {
+	digest, err := ParseDigest(hdr.PAXRecords[paxDigestRecord])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidExport, err)
+	}
+	version := int64(0)
+	if v, ok := hdr.PAXRecords[paxVersionRecord]; ok {
+		version, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: version: %v", ErrInvalidExport, err)
+		}
+	}
+	meta := ObjectMeta{}
+	if m, ok := hdr.PAXRecords[paxMetaRecord]; ok {
+		err = json.Unmarshal([]byte(m), &meta)
+		if err != nil {
+			return fmt.Errorf("%w: metadata: %v", ErrInvalidExport, err)
+		}
+	}
+	h, err := digest.Algorithm.New()
+	if err != nil {
+		return err
+	}
+	w, err := batch.Create(key, func(c *CreateConfig) {
+		c.meta = meta
+		c.version = version
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return err
+	}
+	if got := DigestOf(h); !got.Equal(digest) {
+		return fmt.Errorf("%w: got %s, want %s", ErrDigestMismatch, got, digest)
+	}
+	return w.Close()
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_ExportImport(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:     t.TempDir(),
+		Logger:   zap.Must(zap.NewDevelopment()),
+		Chunking: &ChunkingConfig{MinSize: 1024, AvgSize: 4096, MaxSize: 16384},
+		Codec:    GzipCodec{Level: 5},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	big := randBytes(5, 64*1024)
+	putBlob(t, s, "data/a", []byte("content a"))
+	putBlob(t, s, "data/a", []byte("content a, v1"))
+	putBlob(t, s, "data/big", big)
+	putBlob(t, s, "data/c", []byte("content c"))
+	putBlob(t, s, "other", []byte("not exported"))
+	require.NoError(t, s.SetMeta("data/c", ObjectMeta{ContentType: "text/plain", Tags: []string{"x"}}))
+
+	e, _ := s.blobMap.Get("data/big")
+	bigPath := e.Path
+
+	// writes while the export streams don't change it
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		err := s.Export(pw, "data/")
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	tr := tar.NewReader(pr)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "keys/data/a", hdr.Name)
+	putBlob(t, s, "data/c", []byte("rewritten during export"))
+	require.NoError(t, s.Remove("data/big"))
+	assert.FileExists(t, s.fullPath(bigPath))
+	putBlob(t, s, "data/new", []byte("written during export"))
+
+	exported := new(bytes.Buffer)
+	tw := tar.NewWriter(exported)
+	for {
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = io.Copy(tw, tr)
+		require.NoError(t, err)
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, <-done)
+
+	// the snapshot is done, so the removed content is gone now
+	assert.NoFileExists(t, s.fullPath(bigPath))
+	assert.Empty(t, s.pins)
+	assert.Empty(t, s.deferred)
+
+	dst, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	})
+	require.NoError(t, err)
+	defer dst.Close()
+	require.NoError(t, dst.Import(bytes.NewReader(exported.Bytes())))
+
+	keys, _, err := dst.List("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+	for _, want := range []struct {
+		key     string
+		data    []byte
+		version int64
+	}{
+		{"data/a", []byte("content a, v1"), 1},
+		{"data/big", big, 0},
+		{"data/c", []byte("content c"), 1},
+	} {
+		got, err := dst.ReadFile(want.key)
+		require.NoError(t, err)
+		assert.Equal(t, want.data, got, want.key)
+		info, err := dst.StatKey(want.key)
+		require.NoError(t, err)
+		assert.Equal(t, want.version, info.Sys().(*BlobSys).Version, want.key)
+	}
+	info, err := dst.StatKey("data/c")
+	require.NoError(t, err)
+	assert.Equal(t, ObjectMeta{ContentType: "text/plain", Tags: []string{"x"}}, info.Sys().(*BlobSys).Meta)
+
+	// a corrupt object fails the whole import
+	bad := bytes.Replace(exported.Bytes(), []byte("content a, v1"), []byte("content A, v1"), 1)
+	fresh, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	})
+	require.NoError(t, err)
+	defer fresh.Close()
+	err = fresh.Import(bytes.NewReader(bad))
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+	assert.Equal(t, 0, fresh.blobMap.Len())
+}
+
+func TestBlobStore_ExportLegacy(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// entries written before digests were recorded only have their path
+	putBlob(t, s, "k", []byte("legacy content"))
+	e, _ := s.blobMap.Get("k")
+	e.Digest = ""
+
+	exported := new(bytes.Buffer)
+	require.NoError(t, s.Export(exported, ""))
+
+	dst, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	})
+	require.NoError(t, err)
+	defer dst.Close()
+	require.NoError(t, dst.Import(bytes.NewReader(exported.Bytes())))
+	got, err := dst.ReadFile("k")
+	require.NoError(t, err)
+	assert.Equal(t, "legacy content", string(got))
+}
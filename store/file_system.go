@@ -1,14 +1,25 @@
 package store
 
 import (
+	"errors"
 	"io/fs"
 )
 
+// ErrUnsupported is returned by wrappers like CachedFS for operations
+// their backend doesn't support
+var ErrUnsupported = errors.New("unsupported by the backend")
+
 type WriteFile interface {
 	fs.File
 	Write([]byte) (int, error)
 }
 
+// Aborter is a WriteFile that can be abandoned: Abort discards what was
+// written instead of committing it like Close does
+type Aborter interface {
+	Abort() error
+}
+
 type WriteFS interface {
 	fs.FS
 	Create(name string) (WriteFile, error)
@@ -0,0 +1,298 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// GCConfig configures garbage collection of unreferenced content
+type GCConfig struct {
+	// Interval between the start of background passes. defaults to 1h
+	Interval time.Duration
+	// GracePeriod protects files modified more recently than this, eg
+	// content that is about to be referenced. defaults to 1h
+	GracePeriod time.Duration
+	// DryRun only reports what would be deleted
+	DryRun bool
+	// TempDirs are swept of the stale files of blobs written without a
+	// store, which are named foreverstore-blob-*, eg os.TempDir(). other
+	// files in them are left alone
+	TempDirs []string
+	// OnPass is called at the end of every background pass
+	OnPass func(GCReport, error)
+}
+
+// GCReport summarizes a gc pass
+type GCReport struct {
+	Started  time.Time
+	Finished time.Time
+	DryRun   bool
+	// Live is the number of referenced content paths
+	Live int
+	// Removed are the unreferenced files and empty dirs that were deleted,
+	// or would be in a dry run. paths under the root are relative to it
+	Removed []string
+	// RemovedBytes is the size of the removed files
+	RemovedBytes int64
+	// Kept is the number of unreferenced files within the grace period
+	Kept int
+}
+
+// startGC runs a pass every interval until the store is closed
+func (s *BlobStore) startGC(config GCConfig) {
+	if config.Interval == 0 {
+		config.Interval = time.Hour
+	}
+	s.every(config.Interval, func(ctx context.Context) {
+		report, err := s.GC(ctx, config)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.config.Logger.Sugar().Errorf("gc failed: %v", err)
+		}
+		if config.OnPass != nil {
+			config.OnPass(report, err)
+		}
+	})
+}
+
+// GC deletes content under the root that neither a key nor a chunk
+// manifest references, including packed content, fan out dirs left empty, and staging files of
+// blobs that were never committed. files within the grace period and
+// blobs that are still being written are kept. config.Interval is ignored
+func (s *BlobStore) GC(ctx context.Context, config GCConfig) (GCReport, error) {
+	if config.GracePeriod == 0 {
+		config.GracePeriod = time.Hour
+	}
+	g := &gcPass{
+		s:      s,
+		ctx:    ctx,
+		config: config,
+		cutoff: time.Now().Add(-config.GracePeriod),
+		report: GCReport{
+			Started: time.Now(),
+			DryRun:  config.DryRun,
+			Removed: make([]string, 0),
+		},
+	}
+
+	// mark. the live set only decides what is worth a closer look, every
+	// candidate is checked again under s.mu before it is deleted
+	s.mu.Lock()
+	live := make(map[string]bool)
+	for _, e := range s.blobMap.Values() {
+		live[e.Path] = true
+	}
+	for pth := range s.chunks {
+		live[pth] = true
+	}
+	for pth := range s.pins {
+		live[pth] = true
+	}
+	s.mu.Unlock()
+	g.live = live
+	g.report.Live = len(live)
+
+	// sweep
+	_, err := g.sweepContent(s.config.Root)
+	if err == nil {
+		err = g.sweepPacks()
+	}
+	if err == nil {
+		err = g.sweepTemp(s.journal.stagingDir(), "blob-")
+	}
+	for _, d := range config.TempDirs {
+		if err != nil {
+			break
+		}
+		err = g.sweepTemp(d, tempBlobPrefix)
+	}
+	g.report.Finished = time.Now()
+	s.config.Logger.Sugar().Infof("gc removed %d files and dirs (%d bytes), dry run %v",
+		len(g.report.Removed), g.report.RemovedBytes, config.DryRun)
+	return g.report, err
+}
+
+type gcPass struct {
+	s      *BlobStore
+	ctx    context.Context
+	config GCConfig
+	cutoff time.Time
+	live   map[string]bool
+	report GCReport
+}
+
+// sweepContent removes unreferenced files under dir and reports whether
+// dir is empty afterwards. the bookkeeping dir is skipped
+func (g *gcPass) sweepContent(dir string) (bool, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return true, nil
+		}
+		return false, err
+	}
+	left := len(ents)
+	for _, ent := range ents {
+		if err := g.ctx.Err(); err != nil {
+			return false, err
+		}
+		p := filepath.Join(dir, ent.Name())
+		rel := g.s.relPath(p)
+		if ent.IsDir() {
+			if rel == storeDir {
+				continue
+			}
+			empty, err := g.sweepContent(p)
+			if err != nil {
+				return false, err
+			}
+			if empty && g.removeDir(p) {
+				left--
+			}
+			continue
+		}
+		if g.live[rel] {
+			continue
+		}
+		if g.removeFile(p, func() bool {
+			return g.s.blobMap.Refs(rel) == 0 && g.s.chunks[rel] == nil && g.s.pins[rel] == 0
+		}) {
+			left--
+		}
+	}
+	return left == 0, nil
+}
+
+// sweepPacks removes unreferenced packed content from the pack index. the
+// space is reclaimed when the segments are compacted
+func (g *gcPass) sweepPacks() error {
+	for _, pth := range g.s.packs.paths() {
+		if err := g.ctx.Err(); err != nil {
+			return err
+		}
+		if g.live[pth] {
+			continue
+		}
+		g.removePacked(pth)
+	}
+	return nil
+}
+
+// removePacked is removeFile for packed content
+func (g *gcPass) removePacked(pth string) {
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	loc, ok := g.s.packs.stat(pth)
+	if !ok || g.s.blobMap.Refs(pth) > 0 || g.s.chunks[pth] != nil || g.s.pins[pth] > 0 {
+		return
+	}
+	if loc.Added.After(g.cutoff) {
+		g.report.Kept++
+		return
+	}
+	if !g.config.DryRun {
+		err := g.s.packs.remove(pth)
+		if err != nil {
+			g.s.config.Logger.Sugar().Warnf("gc failed to remove packed %s: %v", pth, err)
+			return
+		}
+	}
+	g.s.config.Logger.Sugar().Debugf("gc removed packed %s", pth)
+	g.report.Removed = append(g.report.Removed, pth)
+	g.report.RemovedBytes += loc.Length
+}
+
+// sweepTemp removes stale files in dir whose name starts with prefix and
+// that aren't being written
+func (g *gcPass) sweepTemp(dir, prefix string) error {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, ent := range ents {
+		if err := g.ctx.Err(); err != nil {
+			return err
+		}
+		if ent.IsDir() || !strings.HasPrefix(ent.Name(), prefix) {
+			continue
+		}
+		p := filepath.Join(dir, ent.Name())
+		g.removeFile(p, func() bool {
+			_, ok := g.s.inflight[p]
+			return !ok
+		})
+	}
+	return nil
+}
+
+// removeFile deletes the file at p if it is older than the grace period
+// and unused still holds under s.mu. it reports whether the file is gone,
+// or would be in a dry run
+func (g *gcPass) removeFile(p string, unused func() bool) bool {
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	info, err := os.Stat(p)
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	if !unused() {
+		return false
+	}
+	if info.ModTime().After(g.cutoff) {
+		g.report.Kept++
+		return false
+	}
+	if !g.config.DryRun {
+		err = os.Remove(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			g.s.config.Logger.Sugar().Warnf("gc failed to remove %s: %v", p, err)
+			return false
+		}
+	}
+	g.s.config.Logger.Sugar().Debugf("gc removed %s", p)
+	g.report.Removed = append(g.report.Removed, g.reportPath(p))
+	g.report.RemovedBytes += info.Size()
+	return true
+}
+
+// removeDir deletes the empty fan out dir p. it is done under s.mu so
+// that a commit doesn't lose the dir between creating and renaming into it
+func (g *gcPass) removeDir(p string) bool {
+	if p == g.s.config.Root {
+		return false
+	}
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	if !g.config.DryRun {
+		ents, err := os.ReadDir(p)
+		if err != nil || len(ents) > 0 {
+			return false
+		}
+		err = os.Remove(p)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				g.s.config.Logger.Sugar().Warnf("gc failed to remove %s: %v", p, err)
+			}
+			return false
+		}
+	}
+	g.report.Removed = append(g.report.Removed, g.reportPath(p))
+	return true
+}
+
+func (g *gcPass) reportPath(p string) string {
+	if strings.HasPrefix(p, g.s.config.Root+string(os.PathSeparator)) {
+		return g.s.relPath(p)
+	}
+	return p
+}
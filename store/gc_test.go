@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_GC(t *testing.T) {
+	root := t.TempDir()
+	tmp := t.TempDir()
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:     root,
+		Logger:   zap.Must(zap.NewDevelopment()),
+		Chunking: &ChunkingConfig{MinSize: 1024, AvgSize: 4096, MaxSize: 16384},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	putBlob(t, s, "small", []byte("live content"))
+	putBlob(t, s, "chunked", randBytes(7, 64*1024))
+
+	old := time.Now().Add(-2 * time.Hour)
+	plant := func(p string) string {
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte("garbage"), 0644))
+		require.NoError(t, os.Chtimes(p, old, old))
+		return p
+	}
+	orphan := plant(filepath.Join(root, "ab", "cd", "orphan"))
+	fresh := filepath.Join(root, "ef", "fresh")
+	require.NoError(t, os.MkdirAll(filepath.Dir(fresh), 0755))
+	require.NoError(t, os.WriteFile(fresh, []byte("just written"), 0644))
+	staged := plant(filepath.Join(s.journal.stagingDir(), "blob-123"))
+	tmpBlob := plant(filepath.Join(tmp, tempBlobPrefix+"456"))
+	other := plant(filepath.Join(tmp, "not-a-blob"))
+	// temp dirs are shared, only files of blobs written without a store are swept
+	foreign := plant(filepath.Join(tmp, "blob-789"))
+
+	// a blob that is still being written is never collected
+	w, err := s.Create("inflight")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("in flight"))
+	require.NoError(t, err)
+	inflight := w.(*Blob).f.Name()
+	require.NoError(t, os.Chtimes(inflight, old, old))
+
+	config := GCConfig{DryRun: true, TempDirs: []string{tmp}}
+	report, err := s.GC(context.Background(), config)
+	require.NoError(t, err)
+	want := []string{
+		filepath.Join("ab", "cd", "orphan"),
+		filepath.Join("ab", "cd"),
+		"ab",
+		filepath.Join(storeDir, stagingDirName, "blob-123"),
+		tmpBlob,
+	}
+	assert.ElementsMatch(t, want, report.Removed)
+	assert.Equal(t, 1, report.Kept)
+	for _, p := range []string{orphan, fresh, staged, tmpBlob, other, foreign, inflight} {
+		assert.FileExists(t, p)
+	}
+
+	config.DryRun = false
+	report, err = s.GC(context.Background(), config)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, want, report.Removed)
+	assert.Equal(t, int64(3*len("garbage")), report.RemovedBytes)
+	for _, p := range []string{orphan, filepath.Join(root, "ab"), staged, tmpBlob} {
+		assert.NoFileExists(t, p)
+		assert.NoDirExists(t, p)
+	}
+	for _, p := range []string{fresh, other, foreign, inflight} {
+		assert.FileExists(t, p)
+	}
+
+	require.NoError(t, w.Close())
+	for key := range map[string]bool{"small": true, "chunked": true, "inflight": true} {
+		_, err := s.ReadFile(key)
+		assert.NoError(t, err, key)
+	}
+
+	// nothing referenced is old enough to matter, but nothing is lost without a grace period either
+	report, err = s.GC(context.Background(), GCConfig{GracePeriod: time.Nanosecond})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{filepath.Join("ef", "fresh"), "ef"}, report.Removed)
+	for key := range map[string]bool{"small": true, "chunked": true, "inflight": true} {
+		_, err := s.ReadFile(key)
+		assert.NoError(t, err, key)
+	}
+}
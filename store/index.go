@@ -0,0 +1,587 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/krehermann/foreverstore/util"
+	"go.uber.org/zap"
+)
+
+// storeDir is reserved under the store root for bookkeeping
+// (index, key records, ...). it is never a valid content path
+const storeDir = ".store"
+
+const (
+	indexLogName = "index.log"
+	keysDirName  = "keys"
+)
+
+// indexEntry is the persisted state of a key
+type indexEntry struct {
+	Key  string `json:"key"`
+	Path string `json:"path"`
+	// Size is the logical size of the content
+	Size int64 `json:"size"`
+	// Digest is the hex multihash of the content
+	Digest  string    `json:"digest,omitempty"`
+	ModTime time.Time `json:"mtime"`
+	// Version counts the puts of the key, starting at 0
+	Version int64 `json:"version,omitempty"`
+	storage
+	ObjectMeta
+}
+
+// storage describes how the content at a path is stored. it is the same
+// for every key referencing the path
+type storage struct {
+	// Chunked is set when the content at Path is a chunk manifest
+	Chunked bool `json:"chunked,omitempty"`
+	// Codec the content was compressed with, if any
+	Codec string `json:"codec,omitempty"`
+	// StoredSize is the size on disk, if it differs from the logical size
+	StoredSize int64 `json:"stored_size,omitempty"`
+	// KeyID is the key the content is encrypted with, if any
+	KeyID string `json:"key_id,omitempty"`
+	// Packed is set when the content is in a pack segment rather than a
+	// file at Path
+	Packed bool `json:"packed,omitempty"`
+}
+
+// storedSize is the size of the content on disk
+func (e *indexEntry) storedSize() int64 {
+	if e.StoredSize != 0 {
+		return e.StoredSize
+	}
+	return e.Size
+}
+
+// digest of the content. entries written before digests were recorded
+// fall back to the digest in the path
+func (e *indexEntry) digest() (Digest, error) {
+	if e.Digest != "" {
+		return ParseDigest(e.Digest)
+	}
+	return digestFromPath(e.Path)
+}
+
+type indexOp string
+
+const (
+	opPut indexOp = "put"
+	opDel indexOp = "del"
+)
+
+// indexRecord is a single line in the index log
+type indexRecord struct {
+	Op    indexOp     `json:"op"`
+	Key   string      `json:"key"`
+	Entry *indexEntry `json:"entry,omitempty"`
+}
+
+var errCorruptIndex = errors.New("corrupt index")
+
+// blobIndex tracks key -> entry relationships and persists them in two places:
+// an append only log that is replayed at startup, and a record file per key
+// that the log can be rebuilt from if it is missing or corrupt. without
+// records, eg for packed stores where they would outnumber the packs, the
+// log is all there is
+type blobIndex struct {
+	mu sync.Mutex // serializes writes to disk
+	// vis is held while changes become visible, so that readers see
+	// all or none of the entries of a PutAll
+	vis     sync.RWMutex
+	root    string
+	log     *os.File
+	entries *util.ConcurrentMap[string, *indexEntry]
+	// paths maps each content path to the keys referencing it. it is
+	// derived from the entries, so it isn't persisted
+	paths map[string]map[string]struct{}
+	// keys are the keys of the entries in order, for listing
+	keys []string
+	lggr *zap.Logger
+	// durability of compactions, the log is synced by Sync
+	durability Durability
+	// records is set when a record file is kept per key
+	records bool
+}
+
+func openIndex(root string, durability Durability, records bool, lggr *zap.Logger) (*blobIndex, error) {
+	idx := &blobIndex{
+		root:       root,
+		entries:    util.NewConcurrentMap[string, *indexEntry](),
+		lggr:       lggr.Named("index"),
+		durability: durability,
+		records:    records,
+	}
+	// the keys dir is created with the log, a new store has neither
+	_, err := os.Stat(idx.keysDir())
+	fresh := errors.Is(err, os.ErrNotExist)
+	err = os.MkdirAll(idx.keysDir(), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = idx.load()
+	if errors.Is(err, os.ErrNotExist) && fresh {
+		err = nil
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errCorruptIndex) {
+			return nil, err
+		}
+		if !records {
+			// the log is the only copy of the keys, it is left for repair
+			return nil, fmt.Errorf("index unusable and there are no key records to rebuild it from: %w", err)
+		}
+		serr := idx.setAside()
+		if serr != nil {
+			return nil, serr
+		}
+		idx.lggr.Sugar().Warnf("index unusable (%v), rebuilding from %s", err, idx.keysDir())
+		idx.entries = util.NewConcurrentMap[string, *indexEntry]()
+		err = idx.rebuild()
+		if err != nil {
+			return nil, err
+		}
+	}
+	idx.paths = make(map[string]map[string]struct{})
+	idx.keys = make([]string, 0, idx.entries.Len())
+	for _, e := range idx.entries.Values() {
+		idx.ref(e)
+		idx.keys = append(idx.keys, e.Key)
+	}
+	sort.Strings(idx.keys)
+	// compact the log so that it only contains live entries
+	err = idx.compact()
+	if err != nil {
+		return nil, err
+	}
+	if !records {
+		// records kept before would go stale, and a rebuild from them
+		// would bring back old entries
+		err = os.RemoveAll(idx.keysDir())
+		if err == nil {
+			err = os.MkdirAll(idx.keysDir(), 0755)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+func (idx *blobIndex) logPath() string {
+	return filepath.Join(idx.root, storeDir, indexLogName)
+}
+
+func (idx *blobIndex) keysDir() string {
+	return filepath.Join(idx.root, storeDir, keysDirName)
+}
+
+// setAside moves an unusable log out of the way of the rebuilt one, so it
+// can still be inspected
+func (idx *blobIndex) setAside() error {
+	dest := fmt.Sprintf("%s.unusable-%d", idx.logPath(), time.Now().UnixNano())
+	err := os.Rename(idx.logPath(), dest)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// recordPath is the location of the record file for key. keys are hashed so
+// that arbitrary key strings are safe file names
+func (idx *blobIndex) recordPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(idx.keysDir(), h[:2], h+".json")
+}
+
+// writeRecord writes the record file of e, if records are kept
+func (idx *blobIndex) writeRecord(e *indexEntry) error {
+	if !idx.records {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	rp := idx.recordPath(e.Key)
+	err = os.MkdirAll(filepath.Dir(rp), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rp, data, DurabilityNone)
+}
+
+func (idx *blobIndex) removeRecord(key string) error {
+	if !idx.records {
+		return nil
+	}
+	err := os.Remove(idx.recordPath(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// load replays the index log. a torn final line, as left by a crash
+// mid-append, is ignored. any other undecodable line is corruption.
+func (idx *blobIndex) load() error {
+	data, err := os.ReadFile(idx.logPath())
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		rec := &indexRecord{}
+		err := json.Unmarshal(line, rec)
+		if err != nil {
+			if i == len(lines)-1 {
+				idx.lggr.Sugar().Warnf("ignoring torn index record at line %d", i+1)
+				break
+			}
+			return fmt.Errorf("%w: line %d: %v", errCorruptIndex, i+1, err)
+		}
+		switch rec.Op {
+		case opPut:
+			if rec.Entry == nil || rec.Entry.Key != rec.Key {
+				return fmt.Errorf("%w: line %d: bad put record", errCorruptIndex, i+1)
+			}
+			idx.entries.Put(rec.Key, rec.Entry)
+		case opDel:
+			idx.entries.Delete(rec.Key)
+		default:
+			return fmt.Errorf("%w: line %d: unknown op '%s'", errCorruptIndex, i+1, rec.Op)
+		}
+	}
+	return nil
+}
+
+// rebuild reconstructs the index by scanning the key records under the root.
+// records that point at missing content are dropped.
+func (idx *blobIndex) rebuild() error {
+	return filepath.WalkDir(idx.keysDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		e := &indexEntry{}
+		err = json.Unmarshal(data, e)
+		if err != nil {
+			idx.lggr.Sugar().Warnf("skipping unreadable key record %s: %v", path, err)
+			return nil
+		}
+		// packed content is checked against the pack index by the store
+		if !e.Packed {
+			_, err = os.Stat(filepath.Join(idx.root, e.Path))
+		}
+		if err != nil {
+			idx.lggr.Sugar().Warnf("dropping key '%s': content %s: %v", e.Key, e.Path, err)
+			os.Remove(path)
+			return nil
+		}
+		idx.entries.Put(e.Key, e)
+		return nil
+	})
+}
+
+// compact rewrites the log with a put per live entry and reopens it for appending
+func (idx *blobIndex) compact() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.log != nil {
+		idx.log.Close()
+		idx.log = nil
+	}
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, e := range idx.entries.Values() {
+		err := enc.Encode(&indexRecord{Op: opPut, Key: e.Key, Entry: e})
+		if err != nil {
+			return err
+		}
+	}
+	err := writeFileAtomic(idx.logPath(), buf.Bytes(), idx.durability)
+	if err != nil {
+		return err
+	}
+	idx.log, err = os.OpenFile(idx.logPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// Sync makes the log durable. idx.mu is only held to get the log, so
+// writers aren't blocked while it syncs
+func (idx *blobIndex) Sync() error {
+	idx.mu.Lock()
+	log := idx.log
+	idx.mu.Unlock()
+	if log == nil {
+		return os.ErrClosed
+	}
+	return log.Sync()
+}
+
+func (idx *blobIndex) append(rec *indexRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = idx.log.Write(append(line, '\n'))
+	return err
+}
+
+func (idx *blobIndex) Get(key string) (*indexEntry, bool) {
+	idx.vis.RLock()
+	defer idx.vis.RUnlock()
+	return idx.entries.Get(key)
+}
+
+func (idx *blobIndex) Values() []*indexEntry {
+	idx.vis.RLock()
+	defer idx.vis.RUnlock()
+	return idx.entries.Values()
+}
+
+func (idx *blobIndex) Len() int {
+	return idx.entries.Len()
+}
+
+// Refs is the number of keys referencing the content at path
+func (idx *blobIndex) Refs(path string) int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return len(idx.paths[path])
+}
+
+// Keys returns the keys referencing the content at path, sorted
+func (idx *blobIndex) Keys(path string) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	out := make([]string, 0, len(idx.paths[path]))
+	for k := range idx.paths[path] {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// List returns up to limit entries with keys that have prefix and sort
+// after the key after, in order. more is set if there are further entries
+func (idx *blobIndex) List(prefix string, after string, limit int) ([]*indexEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	keys, more := page(idx.keys, prefix, after, limit)
+	out := make([]*indexEntry, 0, len(keys))
+	for _, k := range keys {
+		if e, ok := idx.entries.Get(k); ok {
+			out = append(out, e)
+		}
+	}
+	return out, more
+}
+
+// GetByPath returns an entry referencing the content at path
+func (idx *blobIndex) GetByPath(path string) (*indexEntry, bool) {
+	keys := idx.Keys(path)
+	if len(keys) == 0 {
+		return nil, false
+	}
+	return idx.Get(keys[0])
+}
+
+// Put persists e and makes it visible. the entry it replaces, if any, is returned
+func (idx *blobIndex) Put(e *indexEntry) (*indexEntry, error) {
+	prevs, err := idx.PutAll([]*indexEntry{e})
+	if err != nil {
+		return nil, err
+	}
+	return prevs[0], nil
+}
+
+// PutAll persists entries and makes them visible at once. the entries
+// they replace are returned, nil where a key is new. a crash part way
+// may persist some of the entries, callers that need all or none on disk
+// too must journal them
+func (idx *blobIndex) PutAll(entries []*indexEntry) ([]*indexEntry, error) {
+	prevs, _, err := idx.Update(entries, nil)
+	return prevs, err
+}
+
+// Update is PutAll that also deletes the keys dels, which become
+// invisible at once with the puts. the deleted entries are returned too,
+// nil where a key didn't exist. dels must not be put
+func (idx *blobIndex) Update(entries []*indexEntry, dels []string) ([]*indexEntry, []*indexEntry, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	lines := new(bytes.Buffer)
+	latest := make(map[string]*indexEntry)
+	for _, e := range entries {
+		prev, ok := latest[e.Key]
+		if !ok {
+			prev, ok = idx.entries.Get(e.Key)
+		}
+		// a version given for a new key is kept, eg by an import
+		v := int64(0)
+		if ok {
+			v = prev.Version + 1
+		}
+		if ok || e.Version < 0 {
+			e.Version = v
+		}
+		latest[e.Key] = e
+		err := idx.writeRecord(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		line, err := json.Marshal(&indexRecord{Op: opPut, Key: e.Key, Entry: e})
+		if err != nil {
+			return nil, nil, err
+		}
+		lines.Write(append(line, '\n'))
+	}
+	for _, key := range dels {
+		line, err := json.Marshal(&indexRecord{Op: opDel, Key: key})
+		if err != nil {
+			return nil, nil, err
+		}
+		lines.Write(append(line, '\n'))
+	}
+	_, err := idx.log.Write(lines.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range dels {
+		err = idx.removeRecord(key)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	idx.vis.Lock()
+	defer idx.vis.Unlock()
+	prevs := make([]*indexEntry, len(entries))
+	for i, e := range entries {
+		prev, exists := idx.entries.Get(e.Key)
+		if exists {
+			idx.unref(prev)
+			prevs[i] = prev
+		} else {
+			i := sort.SearchStrings(idx.keys, e.Key)
+			idx.keys = append(idx.keys, "")
+			copy(idx.keys[i+1:], idx.keys[i:])
+			idx.keys[i] = e.Key
+		}
+		idx.ref(e)
+		idx.entries.Put(e.Key, e)
+	}
+	deleted := make([]*indexEntry, len(dels))
+	for i, key := range dels {
+		prev, exists := idx.entries.Get(key)
+		if !exists {
+			continue
+		}
+		idx.unref(prev)
+		j := sort.SearchStrings(idx.keys, key)
+		idx.keys = append(idx.keys[:j], idx.keys[j+1:]...)
+		idx.entries.Delete(key)
+		deleted[i] = prev
+	}
+	return prevs, deleted, nil
+}
+
+// Delete removes key from the index, both in memory and on disk
+func (idx *blobIndex) Delete(key string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	err := idx.append(&indexRecord{Op: opDel, Key: key})
+	if err != nil {
+		return err
+	}
+	err = idx.removeRecord(key)
+	if err != nil {
+		return err
+	}
+	if prev, exists := idx.entries.Get(key); exists {
+		idx.unref(prev)
+		i := sort.SearchStrings(idx.keys, key)
+		idx.keys = append(idx.keys[:i], idx.keys[i+1:]...)
+	}
+	idx.entries.Delete(key)
+	return nil
+}
+
+func (idx *blobIndex) ref(e *indexEntry) {
+	keys, ok := idx.paths[e.Path]
+	if !ok {
+		keys = make(map[string]struct{})
+		idx.paths[e.Path] = keys
+	}
+	keys[e.Key] = struct{}{}
+}
+
+func (idx *blobIndex) unref(e *indexEntry) {
+	delete(idx.paths[e.Path], e.Key)
+	if len(idx.paths[e.Path]) == 0 {
+		delete(idx.paths, e.Path)
+	}
+}
+
+func (idx *blobIndex) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.log == nil {
+		return nil
+	}
+	err := idx.log.Close()
+	idx.log = nil
+	return err
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into place.
+// the file and its directory are synced as d requires
+func writeFileAtomic(path string, data []byte, d Durability) error {
+	t, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = t.Write(data)
+	if err == nil && d.syncFiles() {
+		err = t.Sync()
+	}
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(t.Name())
+		return err
+	}
+	err = os.Rename(t.Name(), path)
+	if err != nil || !d.syncDirs() {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
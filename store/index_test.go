@@ -0,0 +1,110 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func putBlob(t testing.TB, s *BlobStore, key string, data []byte) {
+	t.Helper()
+	b, err := s.Create(key)
+	require.NoError(t, err)
+	_, err = b.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+}
+
+func TestBlobStore_IndexReload(t *testing.T) {
+	root := t.TempDir()
+	config := BlobStoreConfig{
+		Root:   root,
+		Logger: zap.Must(zap.NewDevelopment()),
+	}
+	logPath := filepath.Join(root, storeDir, indexLogName)
+
+	reopen := func(s *BlobStore) *BlobStore {
+		require.NoError(t, s.Close())
+		s, err := NewBlobStore(config)
+		require.NoError(t, err)
+		return s
+	}
+
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+	putBlob(t, s, "key1", []byte("content 1"))
+	putBlob(t, s, "key2", []byte("content 2"))
+	putBlob(t, s, "key3", []byte("content 3"))
+	require.NoError(t, s.Remove("key3"))
+
+	checkKeys := func(s *BlobStore) {
+		t.Helper()
+		got, err := s.ReadFile("key1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("content 1"), got)
+		got, err = s.ReadFile("key2")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("content 2"), got)
+		_, err = s.ReadFile("key3")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+
+	t.Run("reload from log", func(t *testing.T) {
+		s = reopen(s)
+		checkKeys(s)
+	})
+
+	t.Run("torn final record", func(t *testing.T) {
+		f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(`{"op":"put","key":"ke`))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		s = reopen(s)
+		checkKeys(s)
+	})
+
+	t.Run("rebuild missing log", func(t *testing.T) {
+		require.NoError(t, s.Close())
+		require.NoError(t, os.Remove(logPath))
+		s, err = NewBlobStore(config)
+		require.NoError(t, err)
+		checkKeys(s)
+	})
+
+	t.Run("rebuild corrupt log", func(t *testing.T) {
+		require.NoError(t, s.Close())
+		require.NoError(t, os.WriteFile(logPath, []byte("garbage\n{}\n"), 0644))
+		s, err = NewBlobStore(config)
+		require.NoError(t, err)
+		checkKeys(s)
+		// the corrupt log is kept aside
+		aside, err := filepath.Glob(logPath + ".unusable-*")
+		require.NoError(t, err)
+		require.Len(t, aside, 1)
+		data, err := os.ReadFile(aside[0])
+		require.NoError(t, err)
+		assert.Equal(t, "garbage\n{}\n", string(data))
+	})
+
+	require.NoError(t, s.Close())
+}
+
+func TestBlobStore_IndexFresh(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.New(core),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// a new store isn't a lost index
+	assert.Equal(t, 0, logs.Len(), logs.All())
+	assert.Equal(t, 0, s.blobMap.Len())
+}
@@ -0,0 +1,298 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	stagingDirName = "staging"
+	journalDirName = "journal"
+)
+
+// writeIntent records that a fully written staging file is about to be
+// moved to Path and registered under Key. intents are written before the
+// rename, and removed once the index update is as durable as configured
+type writeIntent struct {
+	ID string `json:"id"`
+	// Staged and Path are relative to the store root
+	Staged  string    `json:"staged"`
+	Path    string    `json:"path"`
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	Digest  string    `json:"digest"`
+	Created time.Time `json:"created"`
+	// Version is kept if the key is new, see blobIndex.PutAll
+	Version int64 `json:"version,omitempty"`
+	storage
+	ObjectMeta
+	// Batch are the intents of a batch, which are committed together.
+	// the other fields are unset, except ID and Created
+	Batch []*writeIntent `json:"batch,omitempty"`
+	// placed is set when the content was renamed into a dir that still
+	// needs syncing, see flushGroup
+	placed bool
+	// written is the staged file as written. prepared is set when Staged
+	// was encoded from it by prepare, rather than found to be stored
+	// already. pinned are the chunks prepare stored or found, see storeChunks
+	written  string
+	prepared bool
+	pinned   []string
+}
+
+// journal is a directory of in-flight write intents, one file per intent
+type journal struct {
+	root       string
+	lggr       *zap.Logger
+	durability Durability
+}
+
+func openJournal(root string, durability Durability, lggr *zap.Logger) (*journal, error) {
+	j := &journal{
+		root:       root,
+		lggr:       lggr.Named("journal"),
+		durability: durability,
+	}
+	for _, d := range []string{j.dir(), j.stagingDir()} {
+		err := os.MkdirAll(d, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+func (j *journal) dir() string {
+	return filepath.Join(j.root, storeDir, journalDirName)
+}
+
+// stagingDir holds blobs that are still being written. it is on the same
+// filesystem as the content so that committing is a rename
+func (j *journal) stagingDir() string {
+	return filepath.Join(j.root, storeDir, stagingDirName)
+}
+
+func (j *journal) intentPath(id string) string {
+	return filepath.Join(j.dir(), id+".json")
+}
+
+// begin durably records the intent
+func (j *journal) begin(in *writeIntent) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.intentPath(in.ID), data, j.durability)
+}
+
+// end marks the intent as complete
+func (j *journal) end(in *writeIntent) error {
+	err := os.Remove(j.intentPath(in.ID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// pending returns the intents that were never ended, oldest first
+func (j *journal) pending() ([]*writeIntent, error) {
+	ents, err := os.ReadDir(j.dir())
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*writeIntent, 0)
+	for _, ent := range ents {
+		p := filepath.Join(j.dir(), ent.Name())
+		if ent.IsDir() || filepath.Ext(ent.Name()) != ".json" {
+			// leftover from an interrupted atomic write
+			j.lggr.Sugar().Debugf("removing stray journal file %s", p)
+			os.Remove(p)
+			continue
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		in := &writeIntent{}
+		err = json.Unmarshal(data, in)
+		if err != nil {
+			// intents are written atomically, so this is not a torn write.
+			// nothing was renamed for it, drop it and let the staging
+			// sweep clean up
+			j.lggr.Sugar().Warnf("dropping unreadable intent %s: %v", p, err)
+			os.Remove(p)
+			continue
+		}
+		out = append(out, in)
+	}
+	sort.Slice(out, func(i, k int) bool {
+		return out[i].Created.Before(out[k].Created)
+	})
+	return out, nil
+}
+
+// recover completes interrupted commits and rolls back interrupted writes.
+// for every pending intent the staged file is moved into place if that
+// hasn't happened yet and the key is (re)registered. anything left in the
+// staging dir afterwards was never committed and is removed.
+func (s *BlobStore) recover() error {
+	intents, err := s.journal.pending()
+	if err != nil {
+		return err
+	}
+	for _, in := range intents {
+		items := in.Batch
+		if len(items) == 0 {
+			items = []*writeIntent{in}
+		}
+		entries := make([]*indexEntry, 0, len(items))
+		for _, item := range items {
+			ok, err := s.recoverContent(item)
+			if err != nil {
+				return err
+			}
+			if ok {
+				entries = append(entries, item.entry())
+			}
+		}
+		err = s.recoverEntries(entries)
+		if err != nil {
+			return err
+		}
+		if s.config.Durability.syncFiles() {
+			err = s.blobMap.Sync()
+			if err != nil {
+				return err
+			}
+		}
+		err = s.journal.end(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	ents, err := os.ReadDir(s.journal.stagingDir())
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		p := filepath.Join(s.journal.stagingDir(), ent.Name())
+		s.config.Logger.Sugar().Infof("rolling back incomplete write %s", p)
+		err = os.RemoveAll(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverContent makes sure the content of in is in place. it reports
+// false if the content is lost
+func (s *BlobStore) recoverContent(in *writeIntent) (bool, error) {
+	s.config.Logger.Sugar().Infof("recovering write of key '%s' to %s", in.Key, in.Path)
+	staged := s.fullPath(in.Staged)
+	_, err := os.Stat(staged)
+	if err == nil {
+		if in.Packed {
+			err = s.packs.put(in.Path, staged)
+			if err == nil {
+				err = os.Remove(staged)
+			}
+		} else {
+			err = s.recoverStaged(staged, in.Path)
+		}
+		if err != nil {
+			return false, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if !s.contentExists(in.Path, in.storage) {
+		// neither staged nor committed content exists, nothing to recover
+		s.config.Logger.Sugar().Warnf("lost write of key '%s': content %s is missing", in.Key, in.Path)
+		return false, nil
+	}
+	return true, nil
+}
+
+// recoverStaged moves staged into place at pth, unless referenced content
+// is already there. referenced content is either identical or a manifest
+// of it, and must not be replaced. unreferenced content is an orphan that
+// may be stored differently than staged, and is replaced
+func (s *BlobStore) recoverStaged(staged, pth string) error {
+	s.mu.Lock()
+	_, referenced := s.storedAs(pth)
+	s.mu.Unlock()
+	if referenced {
+		return os.Remove(staged)
+	}
+	dest := s.fullPath(pth)
+	err := os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(staged, dest)
+	if err != nil || !s.config.Durability.syncDirs() {
+		return err
+	}
+	return syncDir(filepath.Dir(dest))
+}
+
+// recoverEntries registers the entries of an intent. entries that were
+// registered before the crash are skipped, registering them again would
+// bump their version
+func (s *BlobStore) recoverEntries(entries []*indexEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	todo := make([]*indexEntry, 0, len(entries))
+	for _, e := range entries {
+		cur, ok := s.blobMap.Get(e.Key)
+		if ok && cur.Path == e.Path && cur.Digest == e.Digest {
+			continue
+		}
+		todo = append(todo, e)
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+	return s.registerAll(todo)
+}
+
+// entry is the index entry the intent registers
+func (in *writeIntent) entry() *indexEntry {
+	return &indexEntry{
+		Key:        in.Key,
+		Path:       in.Path,
+		Size:       in.Size,
+		Digest:     in.Digest,
+		ModTime:    in.Created,
+		Version:    in.Version,
+		storage:    in.storage,
+		ObjectMeta: in.ObjectMeta,
+	}
+}
+
+// intentID derives the intent id from the staging file name, which is unique
+func intentID(staged string) string {
+	return strings.TrimPrefix(filepath.Base(staged), "blob-")
+}
+
+// syncDir flushes directory entries (creates, renames) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_Recover(t *testing.T) {
+	config := BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+
+	// stage writes the way Create + Write does, without committing
+	stage := func(data []byte) (string, string) {
+		f, err := os.CreateTemp(s.journal.stagingDir(), "blob-*")
+		require.NoError(t, err)
+		_, err = f.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		h := sha256.New()
+		h.Write(data)
+		return f.Name(), ContentPath(h)
+	}
+
+	// crashed before the intent was written: rolled back
+	abandoned, _ := stage([]byte("abandoned"))
+
+	// crashed after the intent, before the rename: rolled forward
+	staged, pth := stage([]byte("before rename"))
+	require.NoError(t, s.journal.begin(&writeIntent{
+		ID:      intentID(staged),
+		Staged:  s.relPath(staged),
+		Path:    pth,
+		Key:     "before-rename",
+		Created: time.Now(),
+	}))
+
+	// crashed after the rename, before the index update: rolled forward
+	staged2, pth2 := stage([]byte("before index"))
+	require.NoError(t, s.journal.begin(&writeIntent{
+		ID:      intentID(staged2),
+		Staged:  s.relPath(staged2),
+		Path:    pth2,
+		Key:     "before-index",
+		Created: time.Now(),
+	}))
+	require.NoError(t, os.MkdirAll(filepath.Dir(s.fullPath(pth2)), 0755))
+	require.NoError(t, os.Rename(staged2, s.fullPath(pth2)))
+
+	// crashed after the index update, before the intent ended: replaying
+	// it changes nothing
+	putBlob(t, s, "registered", []byte("registered"))
+	e, _ := s.blobMap.Get("registered")
+	require.NoError(t, s.journal.begin(&writeIntent{
+		ID:      "registered",
+		Staged:  filepath.Join(storeDir, stagingDirName, "blob-registered"),
+		Path:    e.Path,
+		Digest:  e.Digest,
+		Key:     "registered",
+		Created: time.Now(),
+	}))
+
+	require.NoError(t, s.Close())
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+
+	info, err := s.StatKey("registered")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Sys().(*BlobSys).Version)
+
+	got, err := s.ReadFile("before-rename")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("before rename"), got)
+
+	got, err = s.ReadFile("before-index")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("before index"), got)
+
+	_, err = os.Stat(abandoned)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	staging, err := os.ReadDir(s.journal.stagingDir())
+	assert.NoError(t, err)
+	assert.Len(t, staging, 0)
+	intents, err := s.journal.pending()
+	assert.NoError(t, err)
+	assert.Len(t, intents, 0)
+}
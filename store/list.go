@@ -0,0 +1,98 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultListLimit is the page size of List when no limit is given
+const DefaultListLimit = 1000
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// KeyInfo describes a stored key
+type KeyInfo struct {
+	Key     string
+	Size    int64
+	Digest  Digest
+	ModTime time.Time
+	Meta    ObjectMeta
+	Version int64
+}
+
+// encodeCursor makes a continuation cursor from the last listed key. the
+// next page starts after that key, so keys added or removed in between
+// don't shift it
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return string(key), nil
+}
+
+// page returns up to limit of the sorted keys that have prefix and sort
+// after after. more is set if there are further keys
+func page(keys []string, prefix string, after string, limit int) ([]string, bool) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	i := sort.SearchStrings(keys, prefix)
+	if after != "" && after >= prefix {
+		i = sort.Search(len(keys), func(i int) bool {
+			return keys[i] > after
+		})
+	}
+	out := make([]string, 0)
+	for ; i < len(keys) && strings.HasPrefix(keys[i], prefix); i++ {
+		if len(out) == limit {
+			return out, true
+		}
+		out = append(out, keys[i])
+	}
+	return out, false
+}
+
+// List returns up to limit keys with prefix in sorted order, starting
+// after cursor. an empty cursor starts at the beginning. the returned
+// cursor continues the listing, it is empty once there are no more keys
+func (s *BlobStore) List(prefix string, cursor string, limit int) ([]KeyInfo, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	entries, more := s.blobMap.List(prefix, after, limit)
+	out := make([]KeyInfo, 0, len(entries))
+	now := time.Now()
+	for _, e := range entries {
+		if e.expired(now) {
+			continue
+		}
+		d, err := e.digest()
+		if err != nil {
+			return nil, "", fmt.Errorf("key %s: %w", e.Key, err)
+		}
+		out = append(out, KeyInfo{
+			Key:     e.Key,
+			Size:    e.Size,
+			Digest:  d,
+			ModTime: e.ModTime,
+			Meta:    e.ObjectMeta.clone(),
+			Version: e.Version,
+		})
+	}
+	next := ""
+	if more {
+		// expired keys are skipped, so the page can be short
+		next = encodeCursor(entries[len(entries)-1].Key)
+	}
+	return out, next, nil
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_List(t *testing.T) {
+	config := BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+
+	for i := 9; i >= 0; i-- {
+		putBlob(t, s, fmt.Sprintf("a/%d", i), []byte(fmt.Sprintf("content %d", i)))
+	}
+	putBlob(t, s, "b/0", []byte("other"))
+	putBlob(t, s, "a", []byte("not in a/"))
+
+	collect := func(prefix string, limit int, between func()) []string {
+		keys := make([]string, 0)
+		cursor := ""
+		for {
+			page, next, err := s.List(prefix, cursor, limit)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(page), limit)
+			for _, info := range page {
+				keys = append(keys, info.Key)
+			}
+			if next == "" {
+				return keys
+			}
+			cursor = next
+			if between != nil {
+				between()
+				between = nil
+			}
+		}
+	}
+	want := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("a/%d", i))
+	}
+	assert.Equal(t, want, collect("a/", 3, nil))
+	assert.Equal(t, append(append([]string{"a"}, want...), "b/0"), collect("", 5, nil))
+	assert.Equal(t, []string{}, collect("c/", 3, nil))
+
+	// keys added and removed before the cursor don't shift the listing
+	got := collect("a/", 4, func() {
+		require.NoError(t, s.Remove("a/0"))
+		putBlob(t, s, "a/00", []byte("new"))
+		putBlob(t, s, "a/99", []byte("new"))
+	})
+	assert.Equal(t, append(want, "a/99"), got)
+
+	page, next, err := s.List("a/9", "", 1)
+	require.NoError(t, err)
+	assert.NotEmpty(t, next)
+	require.Len(t, page, 1)
+	assert.Equal(t, "a/9", page[0].Key)
+	assert.Equal(t, int64(len("content 9")), page[0].Size)
+	e, _ := s.blobMap.Get("a/9")
+	assert.Equal(t, e.Digest, page[0].Digest.String())
+	assert.Equal(t, e.ModTime, page[0].ModTime)
+
+	_, _, err = s.List("", "not a cursor!", 1)
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+
+	// order is restored from the index
+	require.NoError(t, s.Close())
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, []string{"a/00", "a/1", "a/2"}, collect("a/", 3, nil)[:3])
+}
@@ -0,0 +1,489 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MemStoreConfig struct {
+	PathFunc
+	// HashAlgorithm digests new blobs. defaults to DefaultHashAlgorithm
+	HashAlgorithm HashAlgorithm
+}
+
+// MemStore is an in memory ReadWriteStatFS with the key and content
+// addressing semantics of BlobStore: keys map to content paths given by
+// the PathFunc, identical content is stored once, and Stat and ReadDir
+// operate on the content paths. expired keys are hidden, but only dropped
+// when they are overwritten or removed
+type MemStore struct {
+	config MemStoreConfig
+
+	mu      sync.RWMutex
+	entries map[string]*indexEntry
+	// keys are the keys in order, for listing
+	keys []string
+	// content and refs are by content path
+	content map[string][]byte
+	refs    map[string]int
+}
+
+var _ ReadWriteStatFS = (*MemStore)(nil)
+var _ Copier = (*MemStore)(nil)
+
+func NewMemStore(config MemStoreConfig) (*MemStore, error) {
+	if config.PathFunc == nil {
+		config.PathFunc = ContentPath
+	}
+	if config.HashAlgorithm == 0 {
+		config.HashAlgorithm = DefaultHashAlgorithm
+	}
+	if !config.HashAlgorithm.Valid() {
+		return nil, fmt.Errorf("unsupported hash algorithm %s", config.HashAlgorithm)
+	}
+	return &MemStore{
+		config:  config,
+		entries: make(map[string]*indexEntry),
+		keys:    make([]string, 0),
+		content: make(map[string][]byte),
+		refs:    make(map[string]int),
+	}, nil
+}
+
+func (s *MemStore) Create(name string) (WriteFile, error) {
+	return s.CreateWith(name)
+}
+
+// CreateWith is Create with options, eg metadata to store with the key
+func (s *MemStore) CreateWith(name string, opts ...CreateOpt) (WriteFile, error) {
+	config := &CreateConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	err := config.meta.normalize()
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.config.HashAlgorithm.New()
+	if err != nil {
+		return nil, err
+	}
+	return &memBlob{
+		s:       s,
+		key:     name,
+		hash:    h,
+		meta:    config.meta,
+		ttl:     config.ttl,
+		cond:    config.cond,
+		modTime: time.Now(),
+	}, nil
+}
+
+// commit registers the content written to b under its key
+func (s *MemStore) commit(b *memBlob) (*indexEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, exists := s.entries[b.key]
+	now := time.Now()
+	var err error
+	if exists && !prev.expired(now) {
+		var d Digest
+		d, err = prev.digest()
+		if err == nil {
+			err = b.cond.check(b.key, true, d, prev.Version)
+		}
+	} else {
+		err = b.cond.check(b.key, false, Digest{}, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e := &indexEntry{
+		Key:        b.key,
+		Path:       s.config.PathFunc(b.hash),
+		Size:       int64(b.buf.Len()),
+		Digest:     DigestOf(b.hash).String(),
+		ModTime:    now,
+		ObjectMeta: b.meta.withTTL(b.ttl, now),
+	}
+	if _, ok := s.content[e.Path]; !ok {
+		s.content[e.Path] = append([]byte(nil), b.buf.Bytes()...)
+	}
+	s.refs[e.Path]++
+	if exists {
+		e.Version = prev.Version + 1
+		s.release(prev.Path)
+	} else {
+		i := sort.SearchStrings(s.keys, e.Key)
+		s.keys = append(s.keys, "")
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = e.Key
+	}
+	s.entries[e.Key] = e
+	return e, nil
+}
+
+// release drops a reference to the content at pth. s.mu must be held
+func (s *MemStore) release(pth string) {
+	s.refs[pth]--
+	if s.refs[pth] <= 0 {
+		delete(s.refs, pth)
+		delete(s.content, pth)
+	}
+}
+
+// Remove deletes key. the content is only deleted once no other key references it
+func (s *MemStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return fmt.Errorf("%w: %s", os.ErrNotExist, key)
+	}
+	delete(s.entries, key)
+	i := sort.SearchStrings(s.keys, key)
+	s.keys = append(s.keys[:i], s.keys[i+1:]...)
+	s.release(e.Path)
+	return nil
+}
+
+// Copy points dst at the content of src. see BlobStore.Copy
+func (s *MemStore) Copy(src string, dst string) error {
+	return s.copyKey(src, dst, false)
+}
+
+// Rename moves src to dst. see BlobStore.Rename
+func (s *MemStore) Rename(src string, dst string) error {
+	return s.copyKey(src, dst, true)
+}
+
+func (s *MemStore) copyKey(src string, dst string, move bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[src]
+	if !ok || e.expired(time.Now()) {
+		return fmt.Errorf("%w: %s", os.ErrNotExist, src)
+	}
+	if src == dst {
+		return nil
+	}
+	next := *e
+	next.Key = dst
+	next.Version = 0
+	next.ObjectMeta = e.ObjectMeta.clone()
+	if !move {
+		next.ModTime = time.Now()
+	}
+	s.refs[next.Path]++
+	if prev, exists := s.entries[dst]; exists {
+		next.Version = prev.Version + 1
+		s.release(prev.Path)
+	} else {
+		i := sort.SearchStrings(s.keys, dst)
+		s.keys = append(s.keys, "")
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = dst
+	}
+	s.entries[dst] = &next
+	if move {
+		delete(s.entries, src)
+		i := sort.SearchStrings(s.keys, src)
+		s.keys = append(s.keys[:i], s.keys[i+1:]...)
+		s.release(e.Path)
+	}
+	return nil
+}
+
+func (s *MemStore) Open(key string) (fs.File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[key]
+	if !ok || e.expired(time.Now()) {
+		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, key)
+	}
+	digest, err := e.digest()
+	if err != nil {
+		return nil, err
+	}
+	data := s.content[e.Path]
+	b := newReaderBlob(e.Path, bytes.NewReader(data), int64(len(data)), nopCloser{})
+	b.key = e.Key
+	b.meta = e.ObjectMeta.clone()
+	b.version = e.Version
+	b.stored(digest, e.ModTime)
+	return b, nil
+}
+
+func (s *MemStore) ReadFile(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[key]
+	if !ok || e.expired(time.Now()) {
+		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, key)
+	}
+	return append([]byte(nil), s.content[e.Path]...), nil
+}
+
+// StatKey describes key without opening its content. Sys of the result
+// is a *BlobSys
+func (s *MemStore) StatKey(key string) (fs.FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[key]
+	if !ok || e.expired(time.Now()) {
+		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, key)
+	}
+	digest, err := e.digest()
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{
+		name:    e.Path,
+		size:    e.Size,
+		modTime: e.ModTime,
+		sys: &BlobSys{
+			Key:       e.Key,
+			Digest:    digest,
+			Algorithm: digest.Algorithm,
+			Meta:      e.ObjectMeta.clone(),
+			Version:   e.Version,
+		},
+	}, nil
+}
+
+// List returns up to limit keys with prefix in sorted order, starting
+// after cursor. see BlobStore.List
+func (s *MemStore) List(prefix string, cursor string, limit int) ([]KeyInfo, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys, more := page(s.keys, prefix, after, limit)
+	out := make([]KeyInfo, 0, len(keys))
+	now := time.Now()
+	for _, k := range keys {
+		e := s.entries[k]
+		if e.expired(now) {
+			continue
+		}
+		d, err := e.digest()
+		if err != nil {
+			return nil, "", fmt.Errorf("key %s: %w", k, err)
+		}
+		out = append(out, KeyInfo{
+			Key:     e.Key,
+			Size:    e.Size,
+			Digest:  d,
+			ModTime: e.ModTime,
+			Meta:    e.ObjectMeta.clone(),
+			Version: e.Version,
+		})
+	}
+	next := ""
+	if more {
+		next = encodeCursor(keys[len(keys)-1])
+	}
+	return out, next, nil
+}
+
+// cleanPath makes a content path relative, "" is the root
+func cleanPath(p string) string {
+	p = filepath.Clean(p)
+	p = strings.TrimLeft(p, string(os.PathSeparator))
+	if p == "." {
+		return ""
+	}
+	return p
+}
+
+// path is the resolved path in the store, not the key
+func (s *MemStore) Stat(path string) (fs.FileInfo, error) {
+	p := cleanPath(path)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if data, ok := s.content[p]; ok {
+		return &BlobInfo{name: filepath.Base(p), size: int64(len(data))}, nil
+	}
+	if p == "" {
+		return memDirInfo(p), nil
+	}
+	for c := range s.content {
+		if strings.HasPrefix(c, p+string(os.PathSeparator)) {
+			return memDirInfo(p), nil
+		}
+	}
+	return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+}
+
+// path is the resolved path in the store, not the key
+func (s *MemStore) ReadDir(path string) ([]fs.DirEntry, error) {
+	p := cleanPath(path)
+	prefix := ""
+	if p != "" {
+		prefix = p + string(os.PathSeparator)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.content[p]; ok {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: fmt.Errorf("not a directory")}
+	}
+	children := make(map[string]fs.FileInfo)
+	for c, data := range s.content {
+		if !strings.HasPrefix(c, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(c, prefix)
+		name, _, isDir := strings.Cut(rest, string(os.PathSeparator))
+		if isDir {
+			children[name] = memDirInfo(filepath.Join(p, name))
+		} else {
+			children[name] = &BlobInfo{name: name, size: int64(len(data))}
+		}
+	}
+	if len(children) == 0 && p != "" {
+		return nil, &fs.PathError{Op: "readdir", Path: path, Err: fs.ErrNotExist}
+	}
+	out := make([]fs.DirEntry, 0, len(children))
+	for _, info := range children {
+		out = append(out, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name() < out[j].Name()
+	})
+	return out, nil
+}
+
+// memDirInfo is a fan out directory of a MemStore
+type memDirInfo string
+
+func (d memDirInfo) Name() string {
+	return filepath.Base(string(d))
+}
+
+func (memDirInfo) Size() int64 {
+	return 0
+}
+
+func (memDirInfo) Mode() fs.FileMode {
+	return fs.ModeDir | 0755
+}
+
+func (memDirInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (memDirInfo) IsDir() bool {
+	return true
+}
+
+func (memDirInfo) Sys() any {
+	return nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// memBlob is a blob being written to a MemStore
+type memBlob struct {
+	s    *MemStore
+	hash hash.Hash
+	meta ObjectMeta
+	ttl  time.Duration
+	cond condition
+
+	mu      sync.Mutex
+	key     string
+	buf     bytes.Buffer
+	modTime time.Time
+	closed  bool
+	// entry is set once committed
+	entry *indexEntry
+}
+
+var _ WriteFile = (*memBlob)(nil)
+var _ Aborter = (*memBlob)(nil)
+
+func (b *memBlob) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, fs.ErrClosed
+	}
+	b.hash.Write(p)
+	b.modTime = time.Now()
+	return b.buf.Write(p)
+}
+
+func (b *memBlob) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("can't read a writable blob")
+}
+
+func (b *memBlob) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return fs.ErrClosed
+	}
+	b.closed = true
+	e, err := b.s.commit(b)
+	if err != nil {
+		return err
+	}
+	b.entry = e
+	return nil
+}
+
+// Abort discards the written data. it is never committed
+func (b *memBlob) Abort() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return fs.ErrClosed
+	}
+	b.closed = true
+	b.buf.Reset()
+	return nil
+}
+
+func (b *memBlob) Stat() (fs.FileInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.entry == nil {
+		return &BlobInfo{
+			name:    b.key,
+			size:    int64(b.buf.Len()),
+			modTime: b.modTime,
+			sys:     &BlobSys{Key: b.key, Meta: b.meta.clone()},
+		}, nil
+	}
+	d, err := b.entry.digest()
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{
+		name:    b.entry.Path,
+		size:    b.entry.Size,
+		modTime: b.entry.ModTime,
+		sys: &BlobSys{
+			Key:       b.key,
+			Digest:    d,
+			Algorithm: d.Algorithm,
+			Meta:      b.meta.clone(),
+			Version:   b.entry.Version,
+		},
+	}, nil
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+)
+
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
+// ObjectMeta is user supplied information stored with a key. it can be
+// changed without rewriting the content
+type ObjectMeta struct {
+	ContentType string `json:"content_type,omitempty"`
+	// Metadata is arbitrary user key/value pairs
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Tags are kept sorted and without duplicates
+	Tags []string `json:"tags,omitempty"`
+	// Expires is when the key is removed by the reaper, if set. expired
+	// keys can't be read even before they are reaped
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// normalize validates m and sorts and dedups the tags
+func (m *ObjectMeta) normalize() error {
+	for k := range m.Metadata {
+		if k == "" {
+			return fmt.Errorf("%w: empty metadata key", ErrInvalidMetadata)
+		}
+	}
+	if len(m.Metadata) == 0 {
+		m.Metadata = nil
+	}
+	if len(m.Tags) == 0 {
+		m.Tags = nil
+		return nil
+	}
+	tags := append([]string(nil), m.Tags...)
+	sort.Strings(tags)
+	out := tags[:0]
+	for i, t := range tags {
+		if t == "" {
+			return fmt.Errorf("%w: empty tag", ErrInvalidMetadata)
+		}
+		if i > 0 && t == tags[i-1] {
+			continue
+		}
+		out = append(out, t)
+	}
+	m.Tags = out
+	return nil
+}
+
+// clone returns a deep copy, so that callers can't modify stored metadata
+func (m ObjectMeta) clone() ObjectMeta {
+	out := ObjectMeta{ContentType: m.ContentType}
+	if m.Metadata != nil {
+		out.Metadata = make(map[string]string, len(m.Metadata))
+		for k, v := range m.Metadata {
+			out.Metadata[k] = v
+		}
+	}
+	if m.Tags != nil {
+		out.Tags = append([]string(nil), m.Tags...)
+	}
+	if m.Expires != nil {
+		t := *m.Expires
+		out.Expires = &t
+	}
+	return out
+}
+
+type CreateConfig struct {
+	meta ObjectMeta
+	// ttl sets meta.Expires when the key is committed
+	ttl  time.Duration
+	cond condition
+	// version is kept if the key is new, eg when importing
+	version int64
+}
+
+type CreateOpt func(*CreateConfig)
+
+func WithContentType(contentType string) CreateOpt {
+	return func(c *CreateConfig) {
+		c.meta.ContentType = contentType
+	}
+}
+
+// WithMetadata adds user key/value metadata
+func WithMetadata(md map[string]string) CreateOpt {
+	return func(c *CreateConfig) {
+		if c.meta.Metadata == nil {
+			c.meta.Metadata = make(map[string]string, len(md))
+		}
+		for k, v := range md {
+			c.meta.Metadata[k] = v
+		}
+	}
+}
+
+func WithTags(tags ...string) CreateOpt {
+	return func(c *CreateConfig) {
+		c.meta.Tags = append(c.meta.Tags, tags...)
+	}
+}
+
+// SetMeta replaces the metadata of key. the content and its mod time are unchanged
+func (s *BlobStore) SetMeta(key string, meta ObjectMeta) error {
+	meta = meta.clone()
+	err := meta.normalize()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	e, ok := s.blobMap.Get(key)
+	if !ok || e.expired(time.Now()) {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", os.ErrNotExist, key)
+	}
+	next := *e
+	next.ObjectMeta = meta
+	_, err = s.blobMap.Put(&next)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.syncIndex()
+}
+
+// StatKey describes key without opening its content. Sys of the result
+// is a *BlobSys
+func (s *BlobStore) StatKey(key string) (fs.FileInfo, error) {
+	e, ok := s.blobMap.Get(key)
+	if !ok || e.expired(time.Now()) {
+		return nil, fmt.Errorf("%w: %s", os.ErrNotExist, key)
+	}
+	digest, err := e.digest()
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{
+		name:    e.Path,
+		size:    e.Size,
+		modTime: e.ModTime,
+		sys: &BlobSys{
+			Key:       e.Key,
+			Digest:    digest,
+			Algorithm: digest.Algorithm,
+			Meta:      e.ObjectMeta.clone(),
+			Version:   e.Version,
+		},
+	}, nil
+}
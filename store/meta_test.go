@@ -0,0 +1,86 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_Meta(t *testing.T) {
+	config := BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+
+	w, err := s.CreateWith("doc",
+		WithContentType("text/plain"),
+		WithMetadata(map[string]string{"owner": "alice"}),
+		WithTags("b", "a", "b"),
+	)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	want := ObjectMeta{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"owner": "alice"},
+		Tags:        []string{"a", "b"},
+	}
+	meta := func(key string) ObjectMeta {
+		info, err := s.StatKey(key)
+		require.NoError(t, err)
+		f, err := s.Open(key)
+		require.NoError(t, err)
+		defer f.Close()
+		finfo, err := f.Stat()
+		require.NoError(t, err)
+		assert.Equal(t, info.Sys().(*BlobSys).Meta, finfo.Sys().(*BlobSys).Meta)
+		return info.Sys().(*BlobSys).Meta
+	}
+	assert.Equal(t, want, meta("doc"))
+
+	// updating doesn't touch the content
+	before, err := s.StatKey("doc")
+	require.NoError(t, err)
+	want.Metadata["owner"] = "bob"
+	want.Tags = nil
+	require.NoError(t, s.SetMeta("doc", want))
+	want.Metadata["owner"] = "mallory"
+	got := meta("doc")
+	assert.Equal(t, "bob", got.Metadata["owner"])
+	assert.Nil(t, got.Tags)
+	after, err := s.StatKey("doc")
+	require.NoError(t, err)
+	assert.Equal(t, before.ModTime(), after.ModTime())
+	assert.Equal(t, before.Sys().(*BlobSys).Digest, after.Sys().(*BlobSys).Digest)
+	data, err := s.ReadFile("doc")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	assert.ErrorIs(t, s.SetMeta("doc", ObjectMeta{Tags: []string{""}}), ErrInvalidMetadata)
+	_, err = s.CreateWith("bad", WithMetadata(map[string]string{"": "x"}))
+	assert.ErrorIs(t, err, ErrInvalidMetadata)
+
+	// overwriting a key replaces the metadata
+	w, err = s.CreateWith("tmp", WithContentType("text/plain"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	putBlob(t, s, "tmp", []byte("hello"))
+	assert.Equal(t, ObjectMeta{}, meta("tmp"))
+
+	// metadata is persisted with the index
+	require.NoError(t, s.Close())
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, "bob", meta("doc").Metadata["owner"])
+	assert.Equal(t, "text/plain", meta("doc").ContentType)
+	page, _, err := s.List("doc", "", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", page[0].Meta.ContentType)
+}
@@ -26,6 +26,8 @@ type Metastore interface {
 	//	Register(*ObjectRef) error
 	Get(key string, opts ...GetOpt) (*VersionedObjectRef, error)
 	Put(key string, r io.Reader) error
+	// List returns keys with prefix in sorted order, a page at a time
+	List(prefix string, cursor string, limit int) ([]KeyInfo, string, error)
 	//	GetLatest(key string) (*VersionedObjectRef, error)
 	//	Create(key string) (*VersionedObjectRef, error)
 	ReadWriteStatFS
@@ -56,14 +58,43 @@ func (m *MemMeta) Create(key string) (*Blob, error) {
 	return NewWritableBlob(key)
 }
 
-func (m *MemMeta) Register(r *ObjectRef) error {
-	// there is a race here -- multiple clients could be writing
-	// seems to defeat the purpose of concurrent map...
+// Register adds r as the next version of its key. conditions in opts
+// (IfAbsent, IfDigest, IfVersion) are checked against the latest version,
+// other options are ignored
+func (m *MemMeta) Register(r *ObjectRef, opts ...CreateOpt) error {
+	config := &CreateConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	cur, exists := m.m.Get(r.Key)
-	if !exists {
+	if !exists || len(cur) == 0 {
 		cur = make([]*VersionedObjectRef, 0)
+		err := config.cond.check(r.Key, false, Digest{}, 0)
+		if err != nil {
+			return err
+		}
+	} else {
+		latest := cur[0]
+		for _, v := range cur {
+			if v.Version > latest.Version {
+				latest = v
+			}
+		}
+		// paths needn't be content paths unless a digest is required
+		var d Digest
+		if config.cond.ifDigest != nil {
+			var err error
+			d, err = digestFromPath(latest.Path)
+			if err != nil {
+				return fmt.Errorf("key %s: %w", r.Key, err)
+			}
+		}
+		err := config.cond.check(r.Key, true, d, int64(latest.Version))
+		if err != nil {
+			return err
+		}
 	}
 	v := &VersionedObjectRef{
 		ObjectRef: r,
@@ -91,6 +122,47 @@ func (m *MemMeta) Get(key string, version int) (*VersionedObjectRef, error) {
 	return nil, fmt.Errorf("version does not exist")
 }
 
+// List returns the latest version of keys with prefix in sorted order,
+// starting after cursor
+func (m *MemMeta) List(prefix string, cursor string, limit int) ([]KeyInfo, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	latest := make(map[string]*VersionedObjectRef)
+	keys := make([]string, 0)
+	for _, objs := range m.m.Values() {
+		for _, obj := range objs {
+			cur, ok := latest[obj.Key]
+			if !ok {
+				keys = append(keys, obj.Key)
+			}
+			if !ok || obj.Version > cur.Version {
+				latest[obj.Key] = obj
+			}
+		}
+	}
+	sort.Strings(keys)
+	keys, more := page(keys, prefix, after, limit)
+	out := make([]KeyInfo, 0, len(keys))
+	for _, k := range keys {
+		obj := latest[k]
+		info := KeyInfo{Key: k, Size: obj.Size, Meta: obj.Meta.clone(), Version: int64(obj.Version)}
+		if d, err := digestFromPath(obj.Path); err == nil {
+			info.Digest = d
+		}
+		if fi, err := m.fs.Stat(obj.Path); err == nil {
+			info.ModTime = fi.ModTime()
+		}
+		out = append(out, info)
+	}
+	next := ""
+	if more {
+		next = encodeCursor(keys[len(keys)-1])
+	}
+	return out, next, nil
+}
+
 func (m *MemMeta) GetLatest(key string) (*VersionedObjectRef, error) {
 	objs, ok := m.m.Get(key)
 	if !ok {
@@ -0,0 +1,688 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	packDirName   = "packs"
+	packIndexName = "index.log"
+	packExt       = ".pack"
+
+	DefaultPackMaxObjectSize = 8 * 1024
+	DefaultPackSegmentSize   = 64 * 1024 * 1024
+)
+
+// PackConfig configures packing of small objects into segment files
+type PackConfig struct {
+	// MaxObjectSize is the largest stored size that is packed. defaults to 8KiB
+	MaxObjectSize int64
+	// SegmentSize is the size at which a segment is sealed and a new one
+	// is started. defaults to 64MiB
+	SegmentSize int64
+}
+
+func (c *PackConfig) setDefaults() error {
+	if c.MaxObjectSize == 0 {
+		c.MaxObjectSize = DefaultPackMaxObjectSize
+	}
+	if c.SegmentSize == 0 {
+		c.SegmentSize = DefaultPackSegmentSize
+	}
+	if c.MaxObjectSize < 0 || c.SegmentSize < c.MaxObjectSize {
+		return fmt.Errorf("invalid pack sizes: max object %d segment %d", c.MaxObjectSize, c.SegmentSize)
+	}
+	return nil
+}
+
+// segments start with packMagic, followed by records
+//
+//	len(path) u16 | path | len(data) u32 | crc32(data) u32 | data
+//
+// records carry their path so the index can be rebuilt from the segments
+const (
+	packMagic     = "FSP1"
+	packRecordHdr = 2 + 4 + 4
+)
+
+// packLoc is where the data of a packed object is
+type packLoc struct {
+	Segment string `json:"seg"`
+	// Offset of the data in the segment
+	Offset int64     `json:"off"`
+	Length int64     `json:"len"`
+	Added  time.Time `json:"t"`
+}
+
+func (l *packLoc) recordSize(pth string) int64 {
+	return packRecordHdr + int64(len(pth)) + l.Length
+}
+
+// packIndexRecord is a line in the pack index log
+type packIndexRecord struct {
+	Op   indexOp  `json:"op"`
+	Path string   `json:"path"`
+	Loc  *packLoc `json:"loc,omitempty"`
+}
+
+type packSegment struct {
+	id   string
+	size int64
+	// live is the size of the records still in the index
+	live int64
+}
+
+// packStore keeps small objects in append only segment files under
+// Root/.store/packs, and an index of where each content path is. it has its
+// own lock, so reads of packed content don't wait for commits
+type packStore struct {
+	dir  string
+	lggr *zap.Logger
+
+	mu       sync.Mutex
+	objects  map[string]*packLoc
+	segments map[string]*packSegment
+	active   *packSegment
+	// w appends to the active segment
+	w   *os.File
+	log *os.File
+	// segmentSize is when the active segment is sealed
+	segmentSize int64
+	durability  Durability
+	// compactMu serializes compactions, which mostly run without mu
+	compactMu sync.Mutex
+}
+
+func openPacks(root string, segmentSize int64, durability Durability, lggr *zap.Logger) (*packStore, error) {
+	if segmentSize == 0 {
+		segmentSize = DefaultPackSegmentSize
+	}
+	p := &packStore{
+		dir:         filepath.Join(root, storeDir, packDirName),
+		lggr:        lggr.Named("packs"),
+		objects:     make(map[string]*packLoc),
+		segments:    make(map[string]*packSegment),
+		segmentSize: segmentSize,
+		durability:  durability,
+	}
+	err := os.MkdirAll(p.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	ents, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ent := range ents {
+		if ent.IsDir() || filepath.Ext(ent.Name()) != packExt {
+			continue
+		}
+		info, err := ent.Info()
+		if err != nil {
+			return nil, err
+		}
+		id := strings.TrimSuffix(ent.Name(), packExt)
+		p.segments[id] = &packSegment{id: id, size: info.Size()}
+	}
+
+	err = p.load()
+	if errors.Is(err, os.ErrNotExist) && len(p.segments) == 0 {
+		// nothing was packed yet
+		err = nil
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errCorruptIndex) {
+			return nil, err
+		}
+		p.lggr.Sugar().Warnf("pack index unusable (%v), rebuilding from segments", err)
+		p.objects = make(map[string]*packLoc)
+		err = p.rebuild()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for pth, loc := range p.objects {
+		seg, ok := p.segments[loc.Segment]
+		if !ok || loc.Offset+loc.Length > seg.size {
+			p.lggr.Sugar().Warnf("dropping packed %s: segment %s is missing or short", pth, loc.Segment)
+			delete(p.objects, pth)
+			continue
+		}
+		seg.live += loc.recordSize(pth)
+	}
+	err = p.compactLog()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *packStore) segmentPath(id string) string {
+	return filepath.Join(p.dir, id+packExt)
+}
+
+func (p *packStore) logPath() string {
+	return filepath.Join(p.dir, packIndexName)
+}
+
+// load replays the index log. like the key index, a torn final line is ignored
+func (p *packStore) load() error {
+	data, err := os.ReadFile(p.logPath())
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		rec := &packIndexRecord{}
+		err := json.Unmarshal(line, rec)
+		if err != nil {
+			if i == len(lines)-1 {
+				p.lggr.Sugar().Warnf("ignoring torn pack index record at line %d", i+1)
+				break
+			}
+			return fmt.Errorf("%w: pack index line %d: %v", errCorruptIndex, i+1, err)
+		}
+		switch rec.Op {
+		case opPut:
+			if rec.Loc == nil {
+				return fmt.Errorf("%w: pack index line %d: bad put record", errCorruptIndex, i+1)
+			}
+			p.objects[rec.Path] = rec.Loc
+		case opDel:
+			delete(p.objects, rec.Path)
+		default:
+			return fmt.Errorf("%w: pack index line %d: unknown op '%s'", errCorruptIndex, i+1, rec.Op)
+		}
+	}
+	return nil
+}
+
+// rebuild scans the segments in order. objects that were removed come back,
+// they are unreferenced and left for gc
+func (p *packStore) rebuild() error {
+	ids := make([]string, 0, len(p.segments))
+	for id := range p.segments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		err := p.scan(id, func(pth string, loc *packLoc) {
+			p.objects[pth] = loc
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn for every intact record of the segment. scanning stops at
+// a torn or corrupt record
+func (p *packStore) scan(id string, fn func(pth string, loc *packLoc)) error {
+	f, err := os.Open(p.segmentPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(packMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != packMagic {
+		p.lggr.Sugar().Warnf("skipping segment %s: bad header", id)
+		return nil
+	}
+	off := int64(len(packMagic))
+	hdr := make([]byte, packRecordHdr)
+	for {
+		_, err = io.ReadFull(r, hdr[:2])
+		if err != nil {
+			return nil
+		}
+		pth := make([]byte, binary.BigEndian.Uint16(hdr[:2]))
+		_, err = io.ReadFull(r, pth)
+		if err == nil {
+			_, err = io.ReadFull(r, hdr[2:])
+		}
+		if err != nil {
+			return nil
+		}
+		length := int64(binary.BigEndian.Uint32(hdr[2:6]))
+		sum := binary.BigEndian.Uint32(hdr[6:10])
+		dataOff := off + packRecordHdr + int64(len(pth))
+		if dataOff+length > info.Size() {
+			p.lggr.Sugar().Warnf("segment %s is torn at offset %d", id, off)
+			return nil
+		}
+		data := make([]byte, length)
+		_, err = io.ReadFull(r, data)
+		if err != nil || crc32.ChecksumIEEE(data) != sum {
+			p.lggr.Sugar().Warnf("segment %s is corrupt at offset %d", id, off)
+			return nil
+		}
+		fn(string(pth), &packLoc{Segment: id, Offset: dataOff, Length: length, Added: info.ModTime()})
+		off = dataOff + length
+	}
+}
+
+// compactLog rewrites the index log with the live objects and reopens it for appending
+func (p *packStore) compactLog() error {
+	if p.log != nil {
+		p.log.Close()
+		p.log = nil
+	}
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for pth, loc := range p.objects {
+		err := enc.Encode(&packIndexRecord{Op: opPut, Path: pth, Loc: loc})
+		if err != nil {
+			return err
+		}
+	}
+	err := writeFileAtomic(p.logPath(), buf.Bytes(), p.durability)
+	if err != nil {
+		return err
+	}
+	p.log, err = os.OpenFile(p.logPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+func (p *packStore) appendLog(recs ...*packIndexRecord) error {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, rec := range recs {
+		err := enc.Encode(rec)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := p.log.Write(buf.Bytes())
+	return err
+}
+
+// writable returns the active segment, starting a new one if there is
+// none or it can't take n more bytes. p.mu must be held
+func (p *packStore) writable(n int64) (*packSegment, error) {
+	if p.active != nil && (p.active.size+n <= p.segmentSize || p.active.size == int64(len(packMagic))) {
+		return p.active, nil
+	}
+	if p.w != nil {
+		p.w.Close()
+		p.w = nil
+		p.active = nil
+	}
+	next := 0
+	for id := range p.segments {
+		var n int
+		if _, err := fmt.Sscanf(id, "seg-%d", &n); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	seg := &packSegment{id: fmt.Sprintf("seg-%08d", next), size: int64(len(packMagic))}
+	f, err := os.OpenFile(p.segmentPath(seg.id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write([]byte(packMagic))
+	if err == nil && p.durability.syncDirs() {
+		err = syncDir(p.dir)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	p.segments[seg.id] = seg
+	p.active = seg
+	p.w = f
+	return seg, nil
+}
+
+// append writes a record to the active segment without syncing. p.mu must be held
+func (p *packStore) append(pth string, data []byte) (*packLoc, error) {
+	if len(pth) > 0xffff || int64(len(data)) > 0xffffffff {
+		return nil, fmt.Errorf("can't pack %s: too large", pth)
+	}
+	n := packRecordHdr + int64(len(pth)) + int64(len(data))
+	seg, err := p.writable(n)
+	if err != nil {
+		return nil, err
+	}
+	rec := make([]byte, n)
+	binary.BigEndian.PutUint16(rec, uint16(len(pth)))
+	i := 2 + copy(rec[2:], pth)
+	binary.BigEndian.PutUint32(rec[i:], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[i+4:], crc32.ChecksumIEEE(data))
+	copy(rec[i+8:], data)
+	_, err = p.w.WriteAt(rec, seg.size)
+	if err != nil {
+		return nil, err
+	}
+	loc := &packLoc{
+		Segment: seg.id,
+		Offset:  seg.size + packRecordHdr + int64(len(pth)),
+		Length:  int64(len(data)),
+		Added:   time.Now(),
+	}
+	seg.size += n
+	return loc, nil
+}
+
+// sync makes appended records and index lines durable. p.mu must be held
+func (p *packStore) sync() error {
+	if !p.durability.syncFiles() {
+		return nil
+	}
+	if p.w != nil {
+		err := p.w.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return p.log.Sync()
+}
+
+func (p *packStore) has(pth string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.objects[pth]
+	return ok
+}
+
+// put durably packs the file at src as the content at pth, unless it is
+// already packed
+func (p *packStore) put(pth string, src string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return p.putBytes(pth, data)
+}
+
+// putBytes durably packs data as the content at pth, unless it is already packed
+func (p *packStore) putBytes(pth string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.objects[pth]; ok {
+		return nil
+	}
+	loc, err := p.append(pth, data)
+	if err != nil {
+		return err
+	}
+	err = p.appendLog(&packIndexRecord{Op: opPut, Path: pth, Loc: loc})
+	if err == nil {
+		err = p.sync()
+	}
+	if err != nil {
+		return err
+	}
+	p.objects[pth] = loc
+	p.segments[loc.Segment].live += loc.recordSize(pth)
+	return nil
+}
+
+type packReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r *packReader) Close() error {
+	return r.f.Close()
+}
+
+// open returns the stored bytes of pth. the segment is opened under the
+// lock, so compaction can't delete it in between
+func (p *packStore) open(pth string) (readerAtCloser, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loc, ok := p.objects[pth]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: packed %s", os.ErrNotExist, pth)
+	}
+	f, err := os.Open(p.segmentPath(loc.Segment))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &packReader{SectionReader: io.NewSectionReader(f, loc.Offset, loc.Length), f: f}, loc.Length, nil
+}
+
+func (p *packStore) stat(pth string) (packLoc, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loc, ok := p.objects[pth]
+	if !ok {
+		return packLoc{}, false
+	}
+	return *loc, true
+}
+
+// remove drops pth from the index. its space is reclaimed by compaction
+func (p *packStore) remove(pth string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	loc, ok := p.objects[pth]
+	if !ok {
+		return nil
+	}
+	// a lost del record only leaves an unreferenced object for gc
+	err := p.appendLog(&packIndexRecord{Op: opDel, Path: pth})
+	if err != nil {
+		return err
+	}
+	delete(p.objects, pth)
+	p.segments[loc.Segment].live -= loc.recordSize(pth)
+	return nil
+}
+
+// paths returns the packed content paths, sorted
+func (p *packStore) paths() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]string, 0, len(p.objects))
+	for pth := range p.objects {
+		out = append(out, pth)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// PackCompaction summarizes a compaction of the pack segments
+type PackCompaction struct {
+	// Segments that were rewritten or deleted
+	Segments int
+	// Moved is the number of live objects copied to the active segment
+	Moved int
+	// ReclaimedBytes is the space freed
+	ReclaimedBytes int64
+}
+
+// packCompactBatch is how many bytes of live objects compaction reads
+// before it takes p.mu to append them to the active segment
+const packCompactBatch = 1024 * 1024
+
+// compact rewrites sealed segments where at least minGarbage of the
+// space is taken by removed objects. the live objects are appended to the
+// active segment and indexed before the old segment is deleted, so a
+// crash part way only leaves duplicates. they are read without p.mu, in
+// batches, so reads and writes of packed content go on meanwhile
+func (p *packStore) compact(minGarbage float64) (PackCompaction, error) {
+	p.compactMu.Lock()
+	defer p.compactMu.Unlock()
+	out := PackCompaction{}
+
+	p.mu.Lock()
+	ids := make([]string, 0)
+	for id, seg := range p.segments {
+		if seg == p.active {
+			continue
+		}
+		// the header isn't garbage
+		used := seg.size - int64(len(packMagic))
+		garbage := float64(used-seg.live) / float64(used)
+		if seg.live == 0 || (seg.live < used && garbage >= minGarbage) {
+			ids = append(ids, id)
+		}
+	}
+	p.mu.Unlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		moved, reclaimed, err := p.compactSegment(id)
+		if err != nil {
+			return out, err
+		}
+		out.Segments++
+		out.Moved += moved
+		out.ReclaimedBytes += reclaimed
+		p.lggr.Sugar().Infof("compacted segment %s, moved %d objects, reclaimed %d bytes", id, moved, reclaimed)
+	}
+	return out, nil
+}
+
+// packMove is a live object that compaction moves out of a segment
+type packMove struct {
+	pth  string
+	loc  *packLoc
+	data []byte
+}
+
+// compactSegment moves the live objects of the sealed segment id to the
+// active segment and deletes it. p.compactMu must be held
+func (p *packStore) compactSegment(id string) (moved int, reclaimed int64, err error) {
+	p.mu.Lock()
+	seg := p.segments[id]
+	todo := make([]*packMove, 0)
+	for pth, loc := range p.objects {
+		if loc.Segment == id {
+			todo = append(todo, &packMove{pth: pth, loc: loc})
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(todo, func(i, k int) bool {
+		return todo[i].loc.Offset < todo[k].loc.Offset
+	})
+
+	f, err := os.Open(p.segmentPath(id))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	var movedBytes int64
+	for len(todo) > 0 {
+		n := 0
+		var size int64
+		for n < len(todo) && (n == 0 || size+todo[n].loc.Length <= packCompactBatch) {
+			m := todo[n]
+			m.data = make([]byte, m.loc.Length)
+			_, err = f.ReadAt(m.data, m.loc.Offset)
+			if err != nil {
+				return moved, 0, err
+			}
+			size += m.loc.Length
+			n++
+		}
+		count, written, err := p.moveBatch(todo[:n])
+		if err != nil {
+			return moved, 0, err
+		}
+		moved += count
+		movedBytes += written
+		todo = todo[n:]
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err = os.Remove(p.segmentPath(id))
+	if err != nil {
+		return moved, 0, err
+	}
+	delete(p.segments, id)
+	return moved, seg.size - movedBytes, nil
+}
+
+// moveBatch appends and indexes the objects of batch that are still live
+// where they were read from. objects removed or replaced meanwhile are
+// skipped. it returns the number of objects and bytes moved
+func (p *packStore) moveBatch(batch []*packMove) (int, int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recs := make([]*packIndexRecord, 0, len(batch))
+	for _, m := range batch {
+		if p.objects[m.pth] != m.loc {
+			continue
+		}
+		next, err := p.append(m.pth, m.data)
+		if err != nil {
+			return 0, 0, err
+		}
+		next.Added = m.loc.Added
+		recs = append(recs, &packIndexRecord{Op: opPut, Path: m.pth, Loc: next})
+	}
+	if len(recs) == 0 {
+		return 0, 0, nil
+	}
+	err := p.appendLog(recs...)
+	if err == nil {
+		err = p.sync()
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var n int64
+	for _, rec := range recs {
+		old := p.objects[rec.Path]
+		p.segments[old.Segment].live -= old.recordSize(rec.Path)
+		p.objects[rec.Path] = rec.Loc
+		p.segments[rec.Loc.Segment].live += rec.Loc.recordSize(rec.Path)
+		n += rec.Loc.recordSize(rec.Path)
+	}
+	return len(recs), n, nil
+}
+
+// CompactPacks rewrites the sealed pack segments where at least minGarbage
+// (0 to 1) of the space is taken by removed objects, and deletes segments
+// without live objects. objects are removed from the packs when their
+// last key is released or by gc
+func (s *BlobStore) CompactPacks(minGarbage float64) (PackCompaction, error) {
+	if minGarbage < 0 || minGarbage > 1 {
+		return PackCompaction{}, fmt.Errorf("invalid min garbage %v", minGarbage)
+	}
+	return s.packs.compact(minGarbage)
+}
+
+func (p *packStore) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.w != nil {
+		p.w.Close()
+		p.w = nil
+		p.active = nil
+	}
+	if p.log == nil {
+		return nil
+	}
+	err := p.log.Close()
+	p.log = nil
+	return err
+}
@@ -0,0 +1,238 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// contentFiles returns the files under root outside of the bookkeeping dir
+func contentFiles(t *testing.T, root string) []string {
+	out := make([]string, 0)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		if d.IsDir() && d.Name() == storeDir {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() {
+			out = append(out, path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return out
+}
+
+func TestBlobStore_Pack(t *testing.T) {
+	root := t.TempDir()
+	open := func() *BlobStore {
+		s, err := NewBlobStore(BlobStoreConfig{
+			Root:   root,
+			Logger: zap.Must(zap.NewDevelopment()),
+			Pack:   &PackConfig{MaxObjectSize: 1024, SegmentSize: 16 * 1024},
+		})
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+
+	small := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("small-%03d", i)
+		small[key] = bytes.Repeat([]byte{byte(i)}, 500)
+		putBlob(t, s, key, small[key])
+	}
+	putBlob(t, s, "copy", small["small-000"])
+	large := randBytes(1, 4096)
+	putBlob(t, s, "large", large)
+
+	// only the large blob has a file of its own
+	files := contentFiles(t, root)
+	require.Len(t, files, 1)
+	e, _ := s.blobMap.Get("large")
+	assert.Equal(t, s.fullPath(e.Path), files[0])
+	assert.False(t, e.Packed)
+
+	e, _ = s.blobMap.Get("small-000")
+	assert.True(t, e.Packed)
+	info, err := s.Stat(e.Path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(500), info.Size())
+	for key, want := range small {
+		got, err := s.ReadFile(key)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, key)
+	}
+	got, err := s.ReadFile("copy")
+	require.NoError(t, err)
+	assert.Equal(t, small["small-000"], got)
+	assert.Equal(t, 100, len(s.packs.paths()))
+	// nor a key record
+	records, err := os.ReadDir(s.blobMap.keysDir())
+	require.NoError(t, err)
+	assert.Empty(t, records)
+	segments, err := filepath.Glob(filepath.Join(root, storeDir, packDirName, "*"+packExt))
+	require.NoError(t, err)
+	assert.Greater(t, len(segments), 2)
+
+	// removing a key drops its content from the pack once unreferenced
+	require.NoError(t, s.Remove("small-000"))
+	assert.True(t, s.packs.has(e.Path))
+	require.NoError(t, s.Remove("copy"))
+	assert.False(t, s.packs.has(e.Path))
+	for i := 1; i < 80; i++ {
+		require.NoError(t, s.Remove(fmt.Sprintf("small-%03d", i)))
+	}
+	require.NoError(t, s.Close())
+
+	// compaction reclaims the space of removed objects and keeps the rest readable
+	s = open()
+	defer s.Close()
+	_, err = s.CompactPacks(2)
+	assert.Error(t, err)
+	report, err := s.CompactPacks(0.5)
+	require.NoError(t, err)
+	assert.Greater(t, report.Segments, 0)
+	assert.Greater(t, report.ReclaimedBytes, int64(80*500))
+	after, err := filepath.Glob(filepath.Join(root, storeDir, packDirName, "*"+packExt))
+	require.NoError(t, err)
+	assert.Less(t, len(after), len(segments))
+	for i := 80; i < 100; i++ {
+		key := fmt.Sprintf("small-%03d", i)
+		got, err := s.ReadFile(key)
+		require.NoError(t, err)
+		assert.Equal(t, small[key], got, key)
+	}
+
+	// the pack index is rebuilt from the segments if it is lost. objects
+	// removed since the segment was written come back, unreferenced, for gc
+	putBlob(t, s, "removed", []byte("soon unreferenced"))
+	require.NoError(t, s.Remove("removed"))
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Remove(filepath.Join(root, storeDir, packDirName, packIndexName)))
+	s = open()
+	assert.Equal(t, 21, len(s.packs.paths()))
+	for i := 80; i < 100; i++ {
+		key := fmt.Sprintf("small-%03d", i)
+		got, err := s.ReadFile(key)
+		require.NoError(t, err)
+		assert.Equal(t, small[key], got, key)
+	}
+	gc, err := s.GC(context.Background(), GCConfig{GracePeriod: -time.Hour})
+	require.NoError(t, err)
+	assert.Len(t, gc.Removed, 1)
+	assert.Equal(t, 20, len(s.packs.paths()))
+}
+
+func TestBlobStore_PackCompactLive(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   root,
+		Logger: zap.NewNop(),
+		Pack:   &PackConfig{MaxObjectSize: 1024, SegmentSize: 4 * 1024},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 40; i++ {
+		putBlob(t, s, fmt.Sprintf("small-%03d", i), bytes.Repeat([]byte{byte(i)}, 500))
+	}
+	segments, err := filepath.Glob(filepath.Join(root, storeDir, packDirName, "*"+packExt))
+	require.NoError(t, err)
+	require.Greater(t, len(segments), 2)
+
+	// segments without removed objects are left alone, however low the threshold
+	report, err := s.CompactPacks(0)
+	require.NoError(t, err)
+	assert.Equal(t, PackCompaction{}, report)
+	after, err := filepath.Glob(filepath.Join(root, storeDir, packDirName, "*"+packExt))
+	require.NoError(t, err)
+	assert.Equal(t, segments, after)
+
+	require.NoError(t, s.Remove("small-000"))
+	report, err = s.CompactPacks(0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Segments)
+	assert.Equal(t, 6, report.Moved)
+	for i := 1; i < 40; i++ {
+		key := fmt.Sprintf("small-%03d", i)
+		got, err := s.ReadFile(key)
+		require.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 500), got, key)
+	}
+}
+
+func TestBlobStore_PackEncrypted(t *testing.T) {
+	root := t.TempDir()
+	kp, err := NewFileKeyProvider(filepath.Join(t.TempDir(), "keys.json"))
+	require.NoError(t, err)
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:        root,
+		Logger:      zap.Must(zap.NewDevelopment()),
+		KeyProvider: kp,
+		Codec:       GzipCodec{Level: 5},
+		Pack:        &PackConfig{},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	secret := bytes.Repeat([]byte("top secret "), 1000)
+	putBlob(t, s, "secret", secret)
+	e, _ := s.blobMap.Get("secret")
+	assert.True(t, e.Packed)
+	assert.Equal(t, "gzip", e.Codec)
+	assert.Empty(t, contentFiles(t, root))
+
+	got, err := s.ReadFile("secret")
+	require.NoError(t, err)
+	assert.Equal(t, secret, got)
+
+	report, err := s.Scrub(context.Background(), ScrubberConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Files)
+	assert.Empty(t, report.Corrupt)
+}
+
+func TestBlobStore_PackIndexUnusable(t *testing.T) {
+	root := t.TempDir()
+	config := BlobStoreConfig{
+		Root:   root,
+		Logger: zap.NewNop(),
+		Pack:   &PackConfig{},
+	}
+	logPath := filepath.Join(root, storeDir, indexLogName)
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+	putBlob(t, s, "k", []byte("packed"))
+	require.NoError(t, s.Close())
+
+	// without key records the log can't be rebuilt, so it is left alone
+	good, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(logPath, []byte("garbage\n{}\n"), 0644))
+	_, err = NewBlobStore(config)
+	assert.ErrorIs(t, err, errCorruptIndex)
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	assert.Equal(t, "garbage\n{}\n", string(data))
+
+	require.NoError(t, os.Remove(logPath))
+	_, err = NewBlobStore(config)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, os.WriteFile(logPath, good, 0644))
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.ReadFile("k")
+	require.NoError(t, err)
+	assert.Equal(t, "packed", string(got))
+}
@@ -11,10 +11,16 @@ import (
 // maybe i don't need both...
 type PathFunc func(hash.Hash) string
 
+// ContentPath fans out by the leading bytes of the sum. hashes that know their
+// algorithm (see HashAlgorithm.New) are named by the hex multihash so the
+// algorithm is recoverable from the path. others get the legacy plain hex sum.
 func ContentPath(h hash.Hash) string {
 	b := h.Sum(nil)
 	topDir := hex.EncodeToString(b[:1])
 	subDir := hex.EncodeToString(b[1:2])
 	fname := hex.EncodeToString(b)
+	if a, ok := h.(interface{ Algorithm() HashAlgorithm }); ok {
+		fname = Digest{Algorithm: a.Algorithm(), Sum: b}.String()
+	}
 	return filepath.Join(topDir, subDir, fname)
 }
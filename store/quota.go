@@ -0,0 +1,207 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrQuotaExceeded is returned by writes that would take the store, or a
+// key prefix, over its limit
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Usage is the space used by the keys of the store. sizes are logical,
+// ie before deduplication, chunking and compression, so they are an upper
+// bound of the space the content takes on disk
+type Usage struct {
+	// Bytes is the size of all keys
+	Bytes int64
+	// Pending is the size of blobs that are being written
+	Pending int64
+	// Limit is the configured max size, 0 if unlimited
+	Limit int64
+	// Quotas is the usage of each key prefix with a quota
+	Quotas map[string]QuotaUsage
+}
+
+type QuotaUsage struct {
+	Bytes   int64
+	Pending int64
+	Limit   int64
+}
+
+// usage is maintained incrementally as keys are registered and removed,
+// and as bytes are written to blobs that aren't committed yet
+type usage struct {
+	mu      sync.Mutex
+	max     int64
+	quotas  map[string]int64
+	prefix  []string
+	bytes   int64
+	pending int64
+	// per quota prefix
+	prefixBytes   map[string]int64
+	prefixPending map[string]int64
+	// reserved bytes by staging file
+	reserved map[string]int64
+}
+
+func newUsage(max int64, quotas map[string]int64) *usage {
+	u := &usage{
+		max:           max,
+		quotas:        make(map[string]int64, len(quotas)),
+		prefix:        make([]string, 0, len(quotas)),
+		prefixBytes:   make(map[string]int64),
+		prefixPending: make(map[string]int64),
+		reserved:      make(map[string]int64),
+	}
+	for p, limit := range quotas {
+		u.quotas[p] = limit
+		u.prefix = append(u.prefix, p)
+	}
+	sort.Strings(u.prefix)
+	return u
+}
+
+func (u *usage) matching(key string) []string {
+	out := make([]string, 0)
+	for _, p := range u.prefix {
+		if strings.HasPrefix(key, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// add accounts for a change of delta bytes in the size of key
+func (u *usage) add(key string, delta int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.bytes += delta
+	for _, p := range u.matching(key) {
+		u.prefixBytes[p] += delta
+	}
+}
+
+// reserve accounts for n more bytes written to the blob staged at name
+// under key, unless that crosses a limit. credit is the current size of
+// key, which is freed when the blob replaces it
+func (u *usage) reserve(name string, key string, n int64, credit int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	err := u.fits(key, "", n, credit)
+	if err != nil {
+		return err
+	}
+	prefixes := u.matching(key)
+	u.pending += n
+	for _, p := range prefixes {
+		u.prefixPending[p] += n
+	}
+	u.reserved[name] += n
+	return nil
+}
+
+// restore accounts for n bytes that were written to the blob staged at
+// name under key before the store was opened. the limits aren't checked,
+// the bytes are on disk already
+func (u *usage) restore(name string, key string, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending += n
+	for _, p := range u.matching(key) {
+		u.prefixPending[p] += n
+	}
+	u.reserved[name] += n
+}
+
+// check is reserve for changes that don't write data, eg copies, so
+// nothing is reserved. if the bytes are moved from the key from, the
+// limits that already count them aren't checked
+func (u *usage) check(key string, from string, n int64, credit int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.fits(key, from, n, credit)
+}
+
+// fits reports whether n more bytes under key, moved from the key from if
+// it isn't empty, cross a limit. u.mu must be held
+func (u *usage) fits(key string, from string, n int64, credit int64) error {
+	if from == "" && u.max > 0 && u.bytes+u.pending+n > u.max+credit {
+		return fmt.Errorf("%w: writing %d bytes to '%s' exceeds the store limit of %d bytes, %d are in use",
+			ErrQuotaExceeded, n, key, u.max, u.bytes+u.pending)
+	}
+	for _, p := range u.matching(key) {
+		if from != "" && strings.HasPrefix(from, p) {
+			continue
+		}
+		used := u.prefixBytes[p] + u.prefixPending[p]
+		if used+n > u.quotas[p]+credit {
+			return fmt.Errorf("%w: writing %d bytes to '%s' exceeds the quota of %d bytes for prefix '%s', %d are in use",
+				ErrQuotaExceeded, n, key, u.quotas[p], p, used)
+		}
+	}
+	return nil
+}
+
+// unreserve drops what was reserved for the blob staged at name
+func (u *usage) unreserve(name string, key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n, ok := u.reserved[name]
+	if !ok {
+		return
+	}
+	delete(u.reserved, name)
+	u.pending -= n
+	for _, p := range u.matching(key) {
+		u.prefixPending[p] -= n
+	}
+}
+
+func (u *usage) get() Usage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	out := Usage{
+		Bytes:   u.bytes,
+		Pending: u.pending,
+		Limit:   u.max,
+		Quotas:  make(map[string]QuotaUsage, len(u.quotas)),
+	}
+	for p, limit := range u.quotas {
+		out.Quotas[p] = QuotaUsage{
+			Bytes:   u.prefixBytes[p],
+			Pending: u.prefixPending[p],
+			Limit:   limit,
+		}
+	}
+	return out
+}
+
+// Usage reports the current usage against the configured limits
+func (s *BlobStore) Usage() Usage {
+	return s.usage.get()
+}
+
+// reserveWrite is the write fn of blobs created by the store. a refused
+// blob is discarded, so it is no longer in flight. overwriting a key only
+// needs space for the difference, concurrent overwrites of the same key
+// may briefly overshoot a limit by the size of the key
+func (s *BlobStore) reserveWrite(b *Blob, n int64) error {
+	name := b.f.Name()
+	credit := int64(0)
+	if e, ok := s.blobMap.Get(b.key); ok {
+		credit = e.Size
+	}
+	err := s.usage.reserve(name, b.key, n, credit)
+	if err != nil {
+		s.usage.unreserve(name, b.key)
+		s.mu.Lock()
+		delete(s.inflight, name)
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_Quota(t *testing.T) {
+	config := BlobStoreConfig{
+		Root:    t.TempDir(),
+		Logger:  zap.Must(zap.NewDevelopment()),
+		MaxSize: 1000,
+		Quotas:  map[string]int64{"users/a/": 300},
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+
+	putBlob(t, s, "users/a/1", bytes.Repeat([]byte("a"), 200))
+	putBlob(t, s, "users/b/1", bytes.Repeat([]byte("b"), 500))
+	u := s.Usage()
+	assert.Equal(t, int64(700), u.Bytes)
+	assert.Equal(t, int64(1000), u.Limit)
+	assert.Equal(t, QuotaUsage{Bytes: 200, Limit: 300}, u.Quotas["users/a/"])
+
+	// the prefix quota is crossed by the second write
+	b, err := s.Create("users/a/2")
+	require.NoError(t, err)
+	staged := b.(*Blob).f.Name()
+	_, err = b.Write(make([]byte, 50))
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), s.Usage().Pending)
+	_, err = b.Write(make([]byte, 60))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	_, err = os.Stat(staged)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = b.Write([]byte("x"))
+	assert.Error(t, err)
+	assert.Error(t, b.Close())
+	_, err = s.Open("users/a/2")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	u = s.Usage()
+	assert.Equal(t, int64(0), u.Pending)
+	assert.Equal(t, int64(0), u.Quotas["users/a/"].Pending)
+
+	// the store limit, counting in flight writes
+	b1, err := s.Create("x")
+	require.NoError(t, err)
+	_, err = b1.Write(make([]byte, 200))
+	require.NoError(t, err)
+	b2, err := s.Create("y")
+	require.NoError(t, err)
+	_, err = b2.Write(make([]byte, 200))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	require.NoError(t, b1.Close())
+	assert.Equal(t, Usage{Bytes: 900, Limit: 1000, Quotas: map[string]QuotaUsage{"users/a/": {Bytes: 200, Limit: 300}}}, s.Usage())
+
+	// removing and overwriting frees space
+	require.NoError(t, s.Remove("users/b/1"))
+	putBlob(t, s, "users/a/1", bytes.Repeat([]byte("a"), 300))
+	putBlob(t, s, "x", make([]byte, 100))
+	u = s.Usage()
+	assert.Equal(t, int64(400), u.Bytes)
+	assert.Equal(t, int64(300), u.Quotas["users/a/"].Bytes)
+
+	// usage is rebuilt from the index
+	require.NoError(t, s.Close())
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, u, s.Usage())
+}
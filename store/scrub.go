@@ -0,0 +1,399 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const quarantineDirName = "quarantine"
+
+// ScrubberConfig configures integrity scrubbing of the store content
+type ScrubberConfig struct {
+	// Interval between the start of background passes. defaults to 24h
+	Interval time.Duration
+	// BytesPerSecond limits how fast content is read. 0 is unlimited
+	BytesPerSecond int64
+	// OnCorrupt is called for every corrupt file found, after it has been
+	// quarantined. the content can be repaired by writing it again
+	OnCorrupt func(ScrubResult)
+	// OnPass is called at the end of every background pass
+	OnPass func(ScrubReport, error)
+}
+
+// ScrubResult describes a corrupt file
+type ScrubResult struct {
+	// Path of the content, relative to the root
+	Path string
+	// Digest the content should have
+	Digest Digest
+	// Keys whose content this is. empty for chunks and unreferenced files
+	Keys []string
+	// Chunk is set if the content is (also) a chunk of chunked blobs
+	Chunk bool
+	// Err is why the content is corrupt
+	Err error
+	// Quarantined is where the file was moved to, relative to the root
+	Quarantined string
+}
+
+// ScrubReport summarizes a pass over the store
+type ScrubReport struct {
+	Started  time.Time
+	Finished time.Time
+	// Files verified
+	Files int
+	// Bytes read from disk
+	Bytes int64
+	// Skipped files could not be verified, e.g. their path isn't a
+	// digest or they are encrypted with an unknown key
+	Skipped int
+	Corrupt []ScrubResult
+}
+
+// ErrDigestMismatch is returned when content doesn't hash to its digest
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// errContentChanged is returned for content that was replaced while it was
+// verified. it is verified again by the next pass
+var errContentChanged = errors.New("content changed while verified")
+
+func (s *BlobStore) quarantineDir() string {
+	return filepath.Join(s.config.Root, storeDir, quarantineDirName)
+}
+
+// startScrubber runs a pass every interval until the store is closed
+func (s *BlobStore) startScrubber(config ScrubberConfig) {
+	if config.Interval == 0 {
+		config.Interval = 24 * time.Hour
+	}
+	s.every(config.Interval, func(ctx context.Context) {
+		report, err := s.Scrub(ctx, config)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.config.Logger.Sugar().Errorf("scrub failed: %v", err)
+		}
+		if config.OnPass != nil {
+			config.OnPass(report, err)
+		}
+	})
+}
+
+// Scrub verifies every file under the root against the digest in its path.
+// corrupt files are moved to the quarantine dir, and reported to
+// config.OnCorrupt. config.Interval is ignored
+func (s *BlobStore) Scrub(ctx context.Context, config ScrubberConfig) (ScrubReport, error) {
+	report := ScrubReport{
+		Started: time.Now(),
+		Corrupt: make([]ScrubResult, 0),
+	}
+	limiter := &rateLimiter{ctx: ctx, rate: config.BytesPerSecond, start: time.Now()}
+	err := filepath.WalkDir(s.config.Root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// removed while walking
+				return nil
+			}
+			return err
+		}
+		rel := s.relPath(path)
+		if d.IsDir() {
+			if rel == storeDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return s.scrubOne(ctx, config, &report, rel, false, limiter)
+	})
+	if err == nil {
+		for _, rel := range s.packs.paths() {
+			err = s.scrubOne(ctx, config, &report, rel, true, limiter)
+			if err != nil {
+				break
+			}
+		}
+	}
+	report.Finished = time.Now()
+	return report, err
+}
+
+// scrubOne verifies the content at rel and records the outcome in report.
+// only cancellation is returned as an error
+func (s *BlobStore) scrubOne(ctx context.Context, config ScrubberConfig, report *ScrubReport, rel string, packed bool, limiter *rateLimiter) error {
+	res, n, err := s.scrubFile(rel, packed, limiter)
+	report.Bytes += n
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		s.config.Logger.Sugar().Debugf("scrub skipping %s: %v", rel, err)
+		report.Skipped++
+		return nil
+	}
+	report.Files++
+	if res == nil {
+		return nil
+	}
+	s.config.Logger.Sugar().Warnf("scrub found corrupt content %s (%v), quarantined at %s", res.Path, res.Err, res.Quarantined)
+	report.Corrupt = append(report.Corrupt, *res)
+	if config.OnCorrupt != nil {
+		config.OnCorrupt(*res)
+	}
+	return nil
+}
+
+// scrubFile verifies the file at rel, or the packed content if packed is
+// set. a result is returned if it is corrupt. an error means the content
+// could not be verified
+func (s *BlobStore) scrubFile(rel string, packed bool, limiter *rateLimiter) (*ScrubResult, int64, error) {
+	want, err := digestFromPath(rel)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.mu.Lock()
+	st, known := s.storedAs(rel)
+	_, isChunk := s.chunks[rel]
+	s.mu.Unlock()
+	if st.Packed != packed {
+		// eg a leftover file of content that is now packed
+		st = storage{Packed: packed}
+		known = false
+	}
+
+	before, ok := s.contentVersion(rel, packed)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %s", os.ErrNotExist, rel)
+	}
+	var n int64
+	var verr error
+	if st.Chunked {
+		n, verr = s.verifyManifest(rel)
+	} else {
+		n, verr = s.verifyContent(rel, st, want, limiter)
+	}
+	if verr == nil {
+		return nil, n, nil
+	}
+	if known && st.KeyID != "" && (errors.Is(verr, ErrUnknownKey) || s.config.KeyProvider == nil) {
+		// can't tell without the key
+		return nil, n, verr
+	}
+	if errors.Is(verr, os.ErrNotExist) || errors.Is(verr, context.Canceled) {
+		return nil, n, verr
+	}
+
+	res := &ScrubResult{
+		Path:   rel,
+		Digest: want,
+		Chunk:  isChunk,
+		Err:    verr,
+	}
+	err = s.quarantine(res, packed, before)
+	if err != nil {
+		return nil, n, err
+	}
+	return res, n, nil
+}
+
+// verifyContent hashes the decoded content at rel
+func (s *BlobStore) verifyContent(rel string, st storage, want Digest, limiter *rateLimiter) (int64, error) {
+	r, err := s.openContent(rel, st)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	h, err := want.Algorithm.New()
+	if err != nil {
+		return 0, err
+	}
+	cr := &countingReader{r: limiter.reader(&readerAtReader{r: r})}
+	_, err = io.Copy(h, cr)
+	if err != nil {
+		return cr.n, err
+	}
+	if got := DigestOf(h); !got.Equal(want) {
+		return cr.n, fmt.Errorf("%w: got %s", ErrDigestMismatch, got)
+	}
+	return cr.n, nil
+}
+
+// verifyManifest checks that the manifest at rel is intact. the chunks are
+// verified on their own
+func (s *BlobStore) verifyManifest(rel string) (int64, error) {
+	info, err := os.Stat(s.fullPath(rel))
+	if err != nil {
+		return 0, err
+	}
+	m, err := s.readManifest(rel)
+	if err != nil {
+		return info.Size(), err
+	}
+	total := int64(0)
+	for _, c := range m.Chunks {
+		total += c.Size
+		if _, err := digestFromPath(c.Path); err != nil {
+			return info.Size(), fmt.Errorf("bad chunk path %s: %w", c.Path, err)
+		}
+	}
+	if total != m.Size {
+		return info.Size(), fmt.Errorf("chunk sizes add up to %d, manifest size is %d", total, m.Size)
+	}
+	return info.Size(), nil
+}
+
+// contentVersion identifies the stored bytes of content, to tell whether
+// they were replaced while being verified, eg by a repair or a compaction
+type contentVersion struct {
+	info fs.FileInfo
+	loc  packLoc
+}
+
+func (s *BlobStore) contentVersion(rel string, packed bool) (contentVersion, bool) {
+	if packed {
+		loc, ok := s.packs.stat(rel)
+		return contentVersion{loc: loc}, ok
+	}
+	info, err := os.Stat(s.fullPath(rel))
+	return contentVersion{info: info}, err == nil
+}
+
+func (v contentVersion) same(o contentVersion) bool {
+	if v.info == nil || o.info == nil {
+		return v.info == o.info && v.loc.Segment == o.loc.Segment &&
+			v.loc.Offset == o.loc.Offset && v.loc.Length == o.loc.Length
+	}
+	return os.SameFile(v.info, o.info) && v.info.Size() == o.info.Size() &&
+		v.info.ModTime().Equal(o.info.ModTime())
+}
+
+// quarantine moves the corrupt file out of the content tree, unless it
+// changed since before, when it was verified. packed content is copied
+// out and removed from the pack
+func (s *BlobStore) quarantine(res *ScrubResult, packed bool, before contentVersion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now, ok := s.contentVersion(res.Path, packed)
+	if !ok || !before.same(now) {
+		return fmt.Errorf("%w: %s", errContentChanged, res.Path)
+	}
+	res.Keys = s.blobMap.Keys(res.Path)
+
+	err := os.MkdirAll(s.quarantineDir(), 0755)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%d", strings.ReplaceAll(res.Path, string(os.PathSeparator), "_"), time.Now().UnixNano())
+	dest := filepath.Join(s.quarantineDir(), name)
+	if packed {
+		err = s.quarantinePacked(res.Path, dest)
+	} else {
+		err = os.Rename(s.fullPath(res.Path), dest)
+	}
+	if err != nil {
+		return err
+	}
+	res.Quarantined = s.relPath(dest)
+	return nil
+}
+
+// quarantinePacked copies the stored bytes of the packed content at pth to
+// dest and removes it from the pack. s.mu must be held
+func (s *BlobStore) quarantinePacked(pth string, dest string) error {
+	r, size, err := s.packs.open(pth)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	_, err = r.ReadAt(data, 0)
+	r.Close()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	err = writeFileAtomic(dest, data, s.config.Durability)
+	if err != nil {
+		return err
+	}
+	return s.packs.remove(pth)
+}
+
+type readerAtReader struct {
+	r   io.ReaderAt
+	off int64
+}
+
+func (r *readerAtReader) Read(p []byte) (int, error) {
+	n, err := r.r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rateLimiter paces reads to rate bytes per second over a whole pass
+type rateLimiter struct {
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	if l.rate <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+func (l *rateLimiter) wait(n int) error {
+	l.n += int64(n)
+	due := l.start.Add(time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second)))
+	d := time.Until(due)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-l.ctx.Done():
+		return l.ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if werr := r.l.wait(n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func corrupt(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0644))
+}
+
+func TestBlobStore_Scrub(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:     t.TempDir(),
+		Logger:   zap.Must(zap.NewDevelopment()),
+		Codec:    GzipCodec{Level: 5},
+		Chunking: &ChunkingConfig{MinSize: 1024, AvgSize: 4096, MaxSize: 16384},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	raw := randBytes(5, 500)
+	text := bytes.Repeat([]byte("scrub me "), 100)
+	chunked := randBytes(6, 64*1024)
+	putBlob(t, s, "raw", raw)
+	putBlob(t, s, "raw copy", raw)
+	putBlob(t, s, "text", text)
+	putBlob(t, s, "chunked", chunked)
+
+	report, err := s.Scrub(context.Background(), ScrubberConfig{})
+	require.NoError(t, err)
+	assert.Len(t, report.Corrupt, 0)
+	assert.Equal(t, 0, report.Skipped)
+	files := report.Files
+
+	eRaw, _ := s.blobMap.Get("raw")
+	eText, _ := s.blobMap.Get("text")
+	eChunked, _ := s.blobMap.Get("chunked")
+	m, err := s.readManifest(eChunked.Path)
+	require.NoError(t, err)
+	corrupt(t, s.fullPath(eRaw.Path))
+	corrupt(t, s.fullPath(eText.Path))
+	corrupt(t, s.fullPath(m.Chunks[1].Path))
+
+	found := make(map[string]ScrubResult)
+	report, err = s.Scrub(context.Background(), ScrubberConfig{
+		BytesPerSecond: 10 * 1024 * 1024,
+		OnCorrupt: func(r ScrubResult) {
+			found[r.Path] = r
+		},
+	})
+	require.NoError(t, err)
+	assert.Len(t, report.Corrupt, 3)
+	assert.Equal(t, files, report.Files)
+	require.Len(t, found, 3)
+	assert.Equal(t, []string{"raw", "raw copy"}, found[eRaw.Path].Keys)
+	assert.ErrorIs(t, found[eRaw.Path].Err, ErrDigestMismatch)
+	assert.Equal(t, []string{"text"}, found[eText.Path].Keys)
+	assert.True(t, found[m.Chunks[1].Path].Chunk)
+	for _, r := range found {
+		_, err := os.Stat(s.fullPath(r.Quarantined))
+		assert.NoError(t, err)
+	}
+
+	_, err = s.Open("raw")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = s.ReadFile("chunked")
+	assert.Error(t, err)
+
+	// writing the content again repairs it
+	putBlob(t, s, "raw", raw)
+	putBlob(t, s, "text", text)
+	putBlob(t, s, "chunked", chunked)
+	for key, want := range map[string][]byte{"raw": raw, "raw copy": raw, "text": text, "chunked": chunked} {
+		got, err := s.ReadFile(key)
+		assert.NoError(t, err, key)
+		assert.Equal(t, want, got, key)
+	}
+	report, err = s.Scrub(context.Background(), ScrubberConfig{})
+	require.NoError(t, err)
+	assert.Len(t, report.Corrupt, 0)
+
+	// content repaired after it was found corrupt isn't quarantined
+	eText, _ = s.blobMap.Get("text")
+	good, err := os.ReadFile(s.fullPath(eText.Path))
+	require.NoError(t, err)
+	corrupt(t, s.fullPath(eText.Path))
+	before, ok := s.contentVersion(eText.Path, false)
+	require.True(t, ok)
+	require.NoError(t, writeFileAtomic(s.fullPath(eText.Path), good, DurabilityNone))
+	err = s.quarantine(&ScrubResult{Path: eText.Path}, false, before)
+	assert.ErrorIs(t, err, errContentChanged)
+	got, err := s.ReadFile("text")
+	require.NoError(t, err)
+	assert.Equal(t, text, got)
+}
+
+func TestBlobStore_BackgroundScrubber(t *testing.T) {
+	corruptCh := make(chan ScrubResult, 10)
+	root := t.TempDir()
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   root,
+		Logger: zap.Must(zap.NewDevelopment()),
+		Scrubber: &ScrubberConfig{
+			Interval: 10 * time.Millisecond,
+			OnCorrupt: func(r ScrubResult) {
+				corruptCh <- r
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	putBlob(t, s, "key", []byte("will be corrupted"))
+	e, _ := s.blobMap.Get("key")
+	corrupt(t, s.fullPath(e.Path))
+
+	select {
+	case r := <-corruptCh:
+		assert.Equal(t, e.Path, r.Path)
+		assert.Equal(t, []string{"key"}, r.Keys)
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrubber didn't report the corrupt file")
+	}
+	require.NoError(t, s.Close())
+}
@@ -18,6 +18,7 @@ type ObjectRef struct {
 	Path string
 	//	host string
 	Size int64
+	Meta ObjectMeta
 
 	handle fs.File //*os.File
 }
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// WithTTL expires the key ttl after it is committed
+func WithTTL(ttl time.Duration) CreateOpt {
+	return func(c *CreateConfig) {
+		c.ttl = ttl
+		c.meta.Expires = nil
+	}
+}
+
+// WithExpiry expires the key at t
+func WithExpiry(t time.Time) CreateOpt {
+	return func(c *CreateConfig) {
+		c.meta.Expires = &t
+		c.ttl = 0
+	}
+}
+
+// withTTL returns m expiring ttl after now, if ttl is set
+func (m ObjectMeta) withTTL(ttl time.Duration, now time.Time) ObjectMeta {
+	if ttl != 0 {
+		t := now.Add(ttl)
+		m.Expires = &t
+	}
+	return m
+}
+
+// expired reports whether the key has expired at now
+func (m ObjectMeta) expired(now time.Time) bool {
+	return m.Expires != nil && !now.Before(*m.Expires)
+}
+
+// ReaperConfig configures the removal of expired keys
+type ReaperConfig struct {
+	// Interval between the start of background passes. defaults to 1m
+	Interval time.Duration
+	// OnPass is called at the end of every background pass
+	OnPass func(ReapReport, error)
+}
+
+// ReapReport summarizes a reaper pass
+type ReapReport struct {
+	Started  time.Time
+	Finished time.Time
+	// Removed are the expired keys that were removed
+	Removed []string
+	// Uploads are the ids of the expired upload sessions that were removed
+	Uploads []string
+}
+
+// startReaper runs a pass every interval until the store is closed
+func (s *BlobStore) startReaper(config ReaperConfig) {
+	if config.Interval == 0 {
+		config.Interval = time.Minute
+	}
+	s.every(config.Interval, func(ctx context.Context) {
+		report, err := s.Reap(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.config.Logger.Sugar().Errorf("reaping failed: %v", err)
+		}
+		if config.OnPass != nil {
+			config.OnPass(report, err)
+		}
+	})
+}
+
+// Reap removes the keys that have expired, like Remove does, and the
+// upload sessions that have expired
+func (s *BlobStore) Reap(ctx context.Context) (ReapReport, error) {
+	report := ReapReport{
+		Started: time.Now(),
+		Removed: make([]string, 0),
+	}
+	for _, e := range s.blobMap.Values() {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if !e.expired(report.Started) {
+			continue
+		}
+		removed, err := s.reap(e.Key, report.Started)
+		if err != nil {
+			report.Finished = time.Now()
+			return report, err
+		}
+		if removed {
+			report.Removed = append(report.Removed, e.Key)
+		}
+	}
+	ups, err := s.expireUploads(ctx, report.Started)
+	report.Uploads = ups
+	report.Finished = time.Now()
+	if len(report.Removed) == 0 {
+		return report, err
+	}
+	s.config.Logger.Sugar().Infof("reaped %d expired keys", len(report.Removed))
+	// the removes of a pass share a sync. an interrupted pass may lose
+	// some, the keys are still expired and are reaped again
+	if serr := s.syncIndex(); err == nil {
+		err = serr
+	}
+	return report, err
+}
+
+// reap removes key if it is still expired at now, it may have been
+// rewritten or had its expiry changed in the meantime
+func (s *BlobStore) reap(key string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.blobMap.Get(key)
+	if !ok || !e.expired(now) {
+		return false, nil
+	}
+	return true, s.removeEntry(e)
+}
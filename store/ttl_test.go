@@ -0,0 +1,141 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBlobStore_TTL(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   root,
+		Logger: zap.Must(zap.NewDevelopment()),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	put := func(key string, data string, opts ...CreateOpt) {
+		w, err := s.CreateWith(key, opts...)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+	put("scratch", "expired already", WithExpiry(time.Now().Add(-time.Second)))
+	put("later", "expires later", WithTTL(time.Hour))
+	put("forever", "never expires")
+
+	// expired keys are invisible before they are reaped
+	_, err = s.Open("scratch")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = s.ReadFile("scratch")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = s.StatKey("scratch")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	keys, _, err := s.List("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "forever", keys[0].Key)
+	assert.Equal(t, "later", keys[1].Key)
+	require.NotNil(t, keys[1].Meta.Expires)
+
+	// an expired key counts as absent
+	put("scratch", "expired again", IfAbsent(), WithExpiry(time.Now().Add(-time.Second)))
+
+	// the expiry can be changed with the metadata
+	require.NoError(t, s.SetMeta("forever", ObjectMeta{Expires: &time.Time{}}))
+	_, err = s.ReadFile("forever")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	e, _ := s.blobMap.Get("scratch")
+	content := s.fullPath(e.Path)
+	report, err := s.Reap(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"scratch", "forever"}, report.Removed)
+	assert.Equal(t, 1, s.blobMap.Len())
+	assert.NoFileExists(t, content)
+	assert.NoDirExists(t, filepath.Dir(content))
+	got, err := s.ReadFile("later")
+	require.NoError(t, err)
+	assert.Equal(t, "expires later", string(got))
+}
+
+func TestBlobStore_BackgroundReaper(t *testing.T) {
+	passes := make(chan ReapReport, 10)
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.Must(zap.NewDevelopment()),
+		Reaper: &ReaperConfig{
+			Interval: 10 * time.Millisecond,
+			OnPass: func(r ReapReport, err error) {
+				assert.NoError(t, err)
+				passes <- r
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	w, err := s.CreateWith("short lived", WithTTL(50*time.Millisecond))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("gone soon"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case r := <-passes:
+			if len(r.Removed) > 0 {
+				assert.Equal(t, []string{"short lived"}, r.Removed)
+				assert.Equal(t, 0, s.blobMap.Len())
+				return
+			}
+		case <-deadline:
+			t.Fatal("expired key wasn't reaped")
+		}
+	}
+}
+
+func TestBlobStore_TTLFromCommit(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:   t.TempDir(),
+		Logger: zap.NewNop(),
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// the ttl runs from the commit, not from when the option was made or
+	// the upload began
+	ttl := WithTTL(time.Hour)
+	id, err := s.BeginUpload("uploaded", ttl)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	w, err := s.CreateWith("created", ttl)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("created"))
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, w.Close())
+
+	_, err = s.AppendUpload(id, 0, bytes.NewReader([]byte("uploaded")))
+	require.NoError(t, err)
+	_, err = s.CompleteUpload(id)
+	require.NoError(t, err)
+
+	for _, key := range []string{"created", "uploaded"} {
+		info, err := s.StatKey(key)
+		require.NoError(t, err)
+		expires := info.Sys().(*BlobSys).Meta.Expires
+		require.NotNil(t, expires, key)
+		assert.False(t, expires.Before(start.Add(time.Hour)), key)
+	}
+}
@@ -0,0 +1,522 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const uploadsDirName = "uploads"
+
+// DefaultUploadTTL is how long an upload session is kept without appends
+const DefaultUploadTTL = 24 * time.Hour
+
+// ErrUploadNotFound is returned for upload sessions that don't exist, or
+// were completed, aborted or expired
+var ErrUploadNotFound = errors.New("upload not found")
+
+// UploadOffsetError is returned when data is appended to an upload at an
+// offset other than its committed offset. the client should resume from
+// Committed
+type UploadOffsetError struct {
+	ID        string
+	Offset    int64
+	Committed int64
+}
+
+func (e *UploadOffsetError) Error() string {
+	return fmt.Sprintf("upload %s: can't append at offset %d, committed offset is %d", e.ID, e.Offset, e.Committed)
+}
+
+// Uploader writes objects in resumable sessions. the data of a session
+// survives restarts until it is completed or aborted
+type Uploader interface {
+	// BeginUpload starts a session that writes key once completed
+	BeginUpload(key string, opts ...CreateOpt) (string, error)
+	// AppendUpload appends r at offset, which must be the committed offset
+	// of the session. the new committed offset is returned, also when r
+	// fails part way
+	AppendUpload(id string, offset int64, r io.Reader) (int64, error)
+	UploadStatus(id string) (UploadStatus, error)
+	// ListUploads returns the sessions that haven't expired, oldest first
+	ListUploads() ([]UploadStatus, error)
+	// CompleteUpload commits the data of the session to its key. the
+	// session ends, even if the commit fails
+	CompleteUpload(id string) (fs.FileInfo, error)
+	AbortUpload(id string) error
+}
+
+var _ Uploader = (*BlobStore)(nil)
+
+// UploadStatus describes an upload session
+type UploadStatus struct {
+	ID      string
+	Key     string
+	Created time.Time
+	// Offset is the number of bytes durably appended
+	Offset int64
+	// Expires is when the session expires unless more data is appended
+	Expires time.Time
+}
+
+// uploadSession is persisted next to the data of the session. conditions
+// are kept in their exported form
+type uploadSession struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+	ObjectMeta
+	IfAbsent  bool   `json:"if_absent,omitempty"`
+	IfDigest  string `json:"if_digest,omitempty"`
+	IfVersion *int64 `json:"if_version,omitempty"`
+	// TTL sets Expires when the upload completes
+	TTL time.Duration `json:"ttl,omitempty"`
+	// updated is the time of the last append
+	updated time.Time
+}
+
+func (u *uploadSession) condition() (condition, error) {
+	c := condition{ifAbsent: u.IfAbsent, ifVersion: u.IfVersion}
+	if u.IfDigest != "" {
+		d, err := ParseDigest(u.IfDigest)
+		if err != nil {
+			return c, err
+		}
+		c.ifDigest = &d
+	}
+	return c, nil
+}
+
+// uploads are the sessions under Root/.store/uploads. appends to a session
+// are serialized by its lock. sessions without appends for ttl expire,
+// and are removed by the reaper
+type uploads struct {
+	dir string
+	ttl time.Duration
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func openUploads(root string, ttl time.Duration) (*uploads, error) {
+	u := &uploads{
+		dir:   filepath.Join(root, storeDir, uploadsDirName),
+		ttl:   ttl,
+		locks: make(map[string]*sync.Mutex),
+	}
+	return u, os.MkdirAll(u.dir, 0755)
+}
+
+func (u *uploads) sessionPath(id string) string {
+	return filepath.Join(u.dir, id+".json")
+}
+
+func (u *uploads) dataPath(id string) string {
+	return filepath.Join(u.dir, id+".data")
+}
+
+// lock locks the session id and returns the unlock func
+func (u *uploads) lock(id string) func() {
+	u.mu.Lock()
+	l, ok := u.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		u.locks[id] = l
+	}
+	u.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// forget drops the lock of an ended session. the session must be locked
+func (u *uploads) forget(id string) {
+	u.mu.Lock()
+	delete(u.locks, id)
+	u.mu.Unlock()
+}
+
+// get reads the session id and its committed offset. expired sessions
+// aren't found
+func (u *uploads) get(id string) (*uploadSession, int64, error) {
+	sess, committed, err := u.read(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.expired(sess, time.Now()) {
+		return nil, 0, fmt.Errorf("%w: %s expired", ErrUploadNotFound, id)
+	}
+	return sess, committed, nil
+}
+
+func (u *uploads) expired(sess *uploadSession, now time.Time) bool {
+	return !now.Before(sess.updated.Add(u.ttl))
+}
+
+func (u *uploads) status(sess *uploadSession, committed int64) UploadStatus {
+	return UploadStatus{
+		ID:      sess.ID,
+		Key:     sess.Key,
+		Created: sess.Created,
+		Offset:  committed,
+		Expires: sess.updated.Add(u.ttl),
+	}
+}
+
+// ids returns the ids of the sessions, and of data files without a
+// session, eg left by a crash while a session began
+func (u *uploads) ids() ([]string, error) {
+	ents, err := os.ReadDir(u.dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	out := make([]string, 0)
+	for _, ent := range ents {
+		ext := filepath.Ext(ent.Name())
+		if ent.IsDir() || (ext != ".json" && ext != ".data") {
+			continue
+		}
+		id := strings.TrimSuffix(ent.Name(), ext)
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+// read is get without the expiry check
+func (u *uploads) read(id string) (*uploadSession, int64, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, 0, fmt.Errorf("%w: invalid id '%s'", ErrUploadNotFound, id)
+	}
+	data, err := os.ReadFile(u.sessionPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, fmt.Errorf("%w: %s", ErrUploadNotFound, id)
+		}
+		return nil, 0, err
+	}
+	sess := &uploadSession{}
+	err = json.Unmarshal(data, sess)
+	if err != nil {
+		return nil, 0, fmt.Errorf("upload %s: %w", id, err)
+	}
+	info, err := os.Stat(u.dataPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	sess.updated = info.ModTime()
+	return sess, info.Size(), nil
+}
+
+// loadUploads reserves the data of the sessions that haven't expired, as
+// their appends did before the store was opened
+func (s *BlobStore) loadUploads() error {
+	ids, err := s.uploads.ids()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		sess, committed, err := s.uploads.get(id)
+		if errors.Is(err, ErrUploadNotFound) {
+			continue
+		}
+		if err != nil {
+			s.config.Logger.Sugar().Warnf("skipping unreadable upload %s: %v", id, err)
+			continue
+		}
+		s.usage.restore(s.uploads.dataPath(id), sess.Key, committed)
+	}
+	return nil
+}
+
+// BeginUpload starts a resumable upload of key. the create options apply
+// when the upload is completed
+func (s *BlobStore) BeginUpload(key string, opts ...CreateOpt) (string, error) {
+	config := &CreateConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	err := config.meta.normalize()
+	if err != nil {
+		return "", err
+	}
+	raw := make([]byte, 16)
+	_, err = rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	sess := &uploadSession{
+		ID:         hex.EncodeToString(raw),
+		Key:        key,
+		Created:    time.Now(),
+		ObjectMeta: config.meta,
+		TTL:        config.ttl,
+		IfAbsent:   config.cond.ifAbsent,
+		IfVersion:  config.cond.ifVersion,
+	}
+	if config.cond.ifDigest != nil {
+		sess.IfDigest = config.cond.ifDigest.String()
+	}
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return "", err
+	}
+	// the data file exists first, a session file always has one
+	err = writeFileAtomic(s.uploads.dataPath(sess.ID), nil, s.config.Durability)
+	if err == nil {
+		err = writeFileAtomic(s.uploads.sessionPath(sess.ID), data, s.config.Durability)
+	}
+	if err != nil {
+		os.Remove(s.uploads.dataPath(sess.ID))
+		return "", err
+	}
+	s.config.Logger.Sugar().Infof("began upload %s of key '%s'", sess.ID, key)
+	return sess.ID, nil
+}
+
+// AppendUpload appends r to the upload at offset. whatever was read from
+// r is synced before returning, so on error the client can resume from
+// the returned offset
+func (s *BlobStore) AppendUpload(id string, offset int64, r io.Reader) (int64, error) {
+	unlock := s.uploads.lock(id)
+	defer unlock()
+	sess, committed, err := s.uploads.get(id)
+	if err != nil {
+		return 0, err
+	}
+	if offset != committed {
+		return committed, &UploadOffsetError{ID: id, Offset: offset, Committed: committed}
+	}
+	f, err := os.OpenFile(s.uploads.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return committed, err
+	}
+	name := s.uploads.dataPath(id)
+	credit := int64(0)
+	if e, ok := s.blobMap.Get(sess.Key); ok {
+		credit = e.Size
+	}
+	w := &reservingWriter{w: f, reserve: func(n int64) error {
+		return s.usage.reserve(name, sess.Key, n, credit)
+	}}
+	_, err = io.Copy(w, r)
+	if s.config.Durability.syncFiles() {
+		if serr := f.Sync(); err == nil {
+			err = serr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	info, serr := os.Stat(name)
+	if serr != nil {
+		return committed, serr
+	}
+	return info.Size(), err
+}
+
+// reservingWriter reserves space for every write before it is made
+type reservingWriter struct {
+	w       io.Writer
+	reserve func(n int64) error
+}
+
+func (w *reservingWriter) Write(p []byte) (int, error) {
+	err := w.reserve(int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+func (s *BlobStore) UploadStatus(id string) (UploadStatus, error) {
+	unlock := s.uploads.lock(id)
+	defer unlock()
+	sess, committed, err := s.uploads.get(id)
+	if err != nil {
+		return UploadStatus{}, err
+	}
+	return s.uploads.status(sess, committed), nil
+}
+
+func (s *BlobStore) ListUploads() ([]UploadStatus, error) {
+	ids, err := s.uploads.ids()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]UploadStatus, 0, len(ids))
+	for _, id := range ids {
+		st, err := s.UploadStatus(id)
+		if errors.Is(err, ErrUploadNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Created.Before(out[j].Created)
+	})
+	return out, nil
+}
+
+// CompleteUpload commits the uploaded data to the key of the session. the
+// data is moved to the staging dir rather than copied. if the quota is
+// exceeded the session is kept and can be aborted, otherwise it ends
+func (s *BlobStore) CompleteUpload(id string) (fs.FileInfo, error) {
+	unlock := s.uploads.lock(id)
+	defer unlock()
+	sess, size, err := s.uploads.get(id)
+	if err != nil {
+		return nil, err
+	}
+	cond, err := sess.condition()
+	if err != nil {
+		return nil, err
+	}
+	data := s.uploads.dataPath(id)
+	h, err := s.config.HashAlgorithm.New()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// what the appends reserved is moved to the staged file
+	staged := filepath.Join(s.journal.stagingDir(), "blob-upload-"+id)
+	credit := int64(0)
+	if e, ok := s.blobMap.Get(sess.Key); ok {
+		credit = e.Size
+	}
+	s.usage.unreserve(data, sess.Key)
+	err = s.usage.reserve(staged, sess.Key, size, credit)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.inflight[staged] = struct{}{}
+	s.mu.Unlock()
+	err = os.Rename(data, staged)
+	if err != nil {
+		s.mu.Lock()
+		s.usage.unreserve(staged, sess.Key)
+		delete(s.inflight, staged)
+		s.mu.Unlock()
+		return nil, err
+	}
+	os.Remove(s.uploads.sessionPath(id))
+	s.uploads.forget(id)
+
+	b := &Blob{
+		name:    sess.Key,
+		key:     sess.Key,
+		mode:    ReadWrite,
+		hashAlg: s.config.HashAlgorithm,
+		Hash:    h,
+		size:    size,
+		modTime: time.Now(),
+		meta:    sess.ObjectMeta,
+		ttl:     sess.TTL,
+		cond:    cond,
+	}
+	err = s.commit(b, staged)
+	if err != nil {
+		return nil, err
+	}
+	s.config.Logger.Sugar().Infof("completed upload %s of key '%s', %d bytes", id, sess.Key, size)
+	return b.Stat()
+}
+
+// expireUploads removes the sessions that expired at now, releasing what
+// they reserved. data files without a session are removed once they are
+// as old as the ttl. the ids of the removed sessions are returned
+func (s *BlobStore) expireUploads(ctx context.Context, now time.Time) ([]string, error) {
+	ids, err := s.uploads.ids()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+		removed, err := s.expireUpload(id, now)
+		if err != nil {
+			return out, err
+		}
+		if removed {
+			out = append(out, id)
+		}
+	}
+	if len(out) > 0 {
+		s.config.Logger.Sugar().Infof("removed %d expired uploads", len(out))
+	}
+	return out, nil
+}
+
+func (s *BlobStore) expireUpload(id string, now time.Time) (bool, error) {
+	unlock := s.uploads.lock(id)
+	defer unlock()
+	data := s.uploads.dataPath(id)
+	sess, _, err := s.uploads.read(id)
+	if errors.Is(err, ErrUploadNotFound) {
+		// a data file without a session
+		info, serr := os.Stat(data)
+		if serr != nil || now.Before(info.ModTime().Add(s.uploads.ttl)) {
+			return false, nil
+		}
+		s.uploads.forget(id)
+		return true, os.Remove(data)
+	}
+	if err != nil {
+		return false, err
+	}
+	if !s.uploads.expired(sess, now) {
+		return false, nil
+	}
+	s.usage.unreserve(data, sess.Key)
+	err = os.Remove(s.uploads.sessionPath(id))
+	if err != nil {
+		return false, err
+	}
+	s.uploads.forget(id)
+	return true, os.Remove(data)
+}
+
+// AbortUpload deletes the session and its data
+func (s *BlobStore) AbortUpload(id string) error {
+	unlock := s.uploads.lock(id)
+	defer unlock()
+	sess, _, err := s.uploads.get(id)
+	if err != nil {
+		return err
+	}
+	s.usage.unreserve(s.uploads.dataPath(id), sess.Key)
+	err = os.Remove(s.uploads.sessionPath(id))
+	if err != nil {
+		return err
+	}
+	s.uploads.forget(id)
+	return os.Remove(s.uploads.dataPath(id))
+}
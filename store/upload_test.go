@@ -0,0 +1,213 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// failingReader returns n bytes of r, then fails like a dropped connection
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestBlobStore_Upload(t *testing.T) {
+	root := t.TempDir()
+	open := func() *BlobStore {
+		s, err := NewBlobStore(BlobStoreConfig{
+			Root:   root,
+			Logger: zap.Must(zap.NewDevelopment()),
+		})
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+	data := randBytes(3, 256*1024)
+
+	id, err := s.BeginUpload("big", WithContentType("application/octet-stream"), IfAbsent())
+	require.NoError(t, err)
+	off, err := s.AppendUpload(id, 0, &failingReader{r: bytes.NewReader(data), n: 100 * 1024})
+	assert.Error(t, err)
+	assert.Equal(t, int64(100*1024), off)
+	_, err = s.Open("big")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// the session survives a restart
+	require.NoError(t, s.Close())
+	s = open()
+	defer s.Close()
+	st, err := s.UploadStatus(id)
+	require.NoError(t, err)
+	assert.Equal(t, "big", st.Key)
+	assert.Equal(t, int64(100*1024), st.Offset)
+
+	_, err = s.AppendUpload(id, 0, bytes.NewReader(data))
+	var offErr *UploadOffsetError
+	require.ErrorAs(t, err, &offErr)
+	assert.Equal(t, st.Offset, offErr.Committed)
+
+	off, err = s.AppendUpload(id, st.Offset, bytes.NewReader(data[st.Offset:]))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), off)
+	info, err := s.CompleteUpload(id)
+	require.NoError(t, err)
+	sys := info.Sys().(*BlobSys)
+	assert.Equal(t, "big", sys.Key)
+	assert.Equal(t, "application/octet-stream", sys.Meta.ContentType)
+	assert.Equal(t, int64(len(data)), info.Size())
+	got, err := s.ReadFile("big")
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = s.UploadStatus(id)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+
+	// conditions are checked on completion
+	id, err = s.BeginUpload("big", IfAbsent())
+	require.NoError(t, err)
+	_, err = s.AppendUpload(id, 0, bytes.NewReader([]byte("other")))
+	require.NoError(t, err)
+	_, err = s.CompleteUpload(id)
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+
+	// aborted sessions are gone
+	id, err = s.BeginUpload("aborted")
+	require.NoError(t, err)
+	require.NoError(t, s.AbortUpload(id))
+	_, err = s.AppendUpload(id, 0, bytes.NewReader(data))
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	_, err = s.Open("aborted")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestBlobStore_UploadExpiry(t *testing.T) {
+	s, err := NewBlobStore(BlobStoreConfig{
+		Root:      t.TempDir(),
+		Logger:    zap.NewNop(),
+		UploadTTL: time.Hour,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	old, err := s.BeginUpload("old")
+	require.NoError(t, err)
+	_, err = s.AppendUpload(old, 0, bytes.NewReader(randBytes(1, 1024)))
+	require.NoError(t, err)
+	live, err := s.BeginUpload("live")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024), s.Usage().Pending)
+
+	ups, err := s.ListUploads()
+	require.NoError(t, err)
+	require.Len(t, ups, 2)
+	assert.Equal(t, old, ups[0].ID)
+	assert.Equal(t, live, ups[1].ID)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), ups[0].Expires, time.Minute)
+
+	// a session without appends for the ttl expires
+	idle := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(s.uploads.dataPath(old), idle, idle))
+	_, err = s.UploadStatus(old)
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	_, err = s.AppendUpload(old, 1024, bytes.NewReader([]byte("more")))
+	assert.ErrorIs(t, err, ErrUploadNotFound)
+	ups, err = s.ListUploads()
+	require.NoError(t, err)
+	require.Len(t, ups, 1)
+	assert.Equal(t, live, ups[0].ID)
+
+	// the reaper removes it and releases its reservation
+	report, err := s.Reap(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{old}, report.Uploads)
+	assert.Equal(t, int64(0), s.Usage().Pending)
+	_, err = os.Stat(s.uploads.sessionPath(old))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(s.uploads.dataPath(old))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = s.UploadStatus(live)
+	assert.NoError(t, err)
+}
+
+func TestBlobStore_UploadQuota(t *testing.T) {
+	config := BlobStoreConfig{
+		Root:    t.TempDir(),
+		Logger:  zap.NewNop(),
+		MaxSize: 1000,
+	}
+	s, err := NewBlobStore(config)
+	require.NoError(t, err)
+	id, err := s.BeginUpload("upload")
+	require.NoError(t, err)
+	_, err = s.AppendUpload(id, 0, bytes.NewReader(randBytes(1, 800)))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// the data of the session is still reserved after a restart
+	s, err = NewBlobStore(config)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, int64(800), s.Usage().Pending)
+	w, err := s.Create("other")
+	require.NoError(t, err)
+	_, err = w.Write(randBytes(2, 300))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	require.NoError(t, s.AbortUpload(id))
+	assert.Equal(t, int64(0), s.Usage().Pending)
+	putBlob(t, s, "other", randBytes(2, 300))
+}
+
+func TestCachedFS_Upload(t *testing.T) {
+	backend, err := NewBlobStore(BlobStoreConfig{Root: t.TempDir(), Logger: zap.NewNop()})
+	require.NoError(t, err)
+	defer backend.Close()
+	c, err := NewCachedFS(backend, CacheConfig{})
+	require.NoError(t, err)
+	putBlob(t, backend, "k", []byte("cached"))
+	_, err = c.ReadFile("k")
+	require.NoError(t, err)
+
+	id, err := c.BeginUpload("k")
+	require.NoError(t, err)
+	_, err = c.AppendUpload(id, 0, bytes.NewReader([]byte("uploaded")))
+	require.NoError(t, err)
+	ups, err := c.ListUploads()
+	require.NoError(t, err)
+	require.Len(t, ups, 1)
+	_, err = c.CompleteUpload(id)
+	require.NoError(t, err)
+	got, err := c.ReadFile("k")
+	require.NoError(t, err)
+	assert.Equal(t, "uploaded", string(got))
+
+	// a backend without uploads
+	mem, err := NewMemStore(MemStoreConfig{})
+	require.NoError(t, err)
+	c, err = NewCachedFS(mem, CacheConfig{})
+	require.NoError(t, err)
+	_, err = c.BeginUpload("k")
+	assert.ErrorIs(t, err, ErrUnsupported)
+}